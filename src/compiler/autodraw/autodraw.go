@@ -23,13 +23,11 @@ import "flag"
 import "fmt"
 import "os"
 import "log"
-import "bufio"
 import "strings"
 import "io/ioutil"
+import "path/filepath"
 import "compiler/fsm"
-import "compiler/operation"
-
-//import "compiler/instruction"
+import "compiler/instruction"
 
 const Version string = "1.0"
 
@@ -37,6 +35,20 @@ var verbose bool
 var help bool
 var inputFileName string
 var outputFileName string
+var includeDirs pathList
+var wide bool
+
+// pathList is a flag that can be given multiple times, collecting the values
+type pathList []string
+
+func (list *pathList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *pathList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
 
 func usage(info string) {
 	fmt.Fprintf(os.Stderr, "This is autodraw, version %s\n", Version)
@@ -53,6 +65,9 @@ func main() {
 	flag.BoolVar(&help, "help", false, "show help message")
 	flag.StringVar(&outputFileName, "o", "", "output file name")
 	flag.StringVar(&outputFileName, "output", "a.anm", "output file name")
+	flag.Var(&includeDirs, "I", "add directory to the search path of import")
+	flag.BoolVar(&wide, "wide", false,
+		"write 32-bit coordinates, for drawings beyond 16-bit range")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s inputFile [options]\noptions:\n", os.Args[0])
 		flag.PrintDefaults()
@@ -73,34 +88,35 @@ func main() {
 
 	inputFileName = args[0]
 
-	file, err := os.Open(inputFileName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	lineno := 1
 	compiler := fsm.NewFSM()
 	compiler.Verbose = verbose
-	parser := operation.NewLineParser()
+	compiler.SetFile(inputFileName)
+	compiler.AddSearchPath(includeDirs...)
+	if wide {
+		compiler.SetEncoding(instruction.WORD32)
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.Trim(line, " ")
-		if line == "" {
-			continue
-		}
-		oper, err := parser.ParseLine(line)
-		if err != nil {
-			log.Fatal(err)
+	// All the errors are reported, each at its place in the script, and
+	// nothing is written if there is any
+	err := compiler.CompileFile(inputFileName)
+	if errs, ok := err.(fsm.ErrorList); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
 		}
-		compiler.Update(oper)
-
-		lineno++
+		fmt.Fprintf(os.Stderr, "%d error(s) in %s\n", len(errs), inputFileName)
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
 	}
 
-	err = ioutil.WriteFile(outputFileName, compiler.DumpInstructions(), 0644)
+	metadata := map[string]string{
+		"generator": "autodraw " + Version,
+		"source":    filepath.Base(inputFileName),
+	}
+	data, err := compiler.DumpFile(metadata)
+	if err == nil {
+		err = ioutil.WriteFile(outputFileName, data, 0644)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -20,11 +20,32 @@ generated instructions can be dumped to byte string.
 */
 package fsm
 
+import (
+	"strings"
+	"compiler/operation"
+)
+
+// FSMError is an error in running an operation, at the position Pos. If the
+// operation is run by DRAW, or in a loop, Chain lists the operations it is
+// run by, the innermost first.
 type FSMError struct {
-	oper   string
-	reason string
+	oper    string
+	reason  string
+	Pos     operation.Position
+	Chain   []Call
+	located bool
+}
+
+// Call is an operation running others, as recorded in the chain of an FSMError
+type Call struct {
+	Oper string
+	Pos  operation.Position
 }
 
+// ErrorList collects the errors in compiling a file, in the order they are
+// found
+type ErrorList []error
+
 type VartableError struct {
 	reason string
 }
@@ -33,6 +54,10 @@ type ArgError struct {
 	reason string
 }
 
+type ImportError struct {
+	reason string
+}
+
 func NewVartableError(reason string) *VartableError {
 	e := VartableError{reason}
 	return &e
@@ -43,13 +68,59 @@ func NewArgError(reason string) *ArgError {
 	return &e
 }
 
+func NewImportError(reason string) *ImportError {
+	e := ImportError{reason}
+	return &e
+}
+
 func NewFSMError(oper string, reason string) *FSMError {
-	e := FSMError{oper, reason}
+	e := FSMError{oper, reason, operation.Position{}, nil, false}
 	return &e
 }
 
+// FSMError.at puts the error at a position, unless it already has one
+func (e *FSMError) at(pos operation.Position) *FSMError {
+	if !e.located {
+		e.Pos = pos
+		e.located = true
+	}
+	return e
+}
+
+// FSMError.calledBy adds an operation to the chain of the error
+func (e *FSMError) calledBy(oper string, pos operation.Position) *FSMError {
+	e.Chain = append(e.Chain, Call{oper, pos})
+	return e
+}
+
 func (e *FSMError) Error() string {
-	return "FSM error: " + e.oper + ": " + e.reason
+	ret := "FSM error: " + e.oper + ": " + e.reason
+	if e.Pos.IsValid() {
+		ret = e.Pos.String() + ": " + ret
+	}
+	for _, call := range e.Chain {
+		ret += "\n\tin " + call.Oper
+		if call.Pos.IsValid() {
+			ret += " at " + call.Pos.String()
+		}
+	}
+	return ret
+}
+
+func (list ErrorList) Error() string {
+	reasons := make([]string, len(list))
+	for i, err := range list {
+		reasons[i] = err.Error()
+	}
+	return strings.Join(reasons, "\n")
+}
+
+// ErrorList.append adds an error to the list, or all of them if it is a list
+func (list ErrorList) append(err error) ErrorList {
+	if errs, ok := err.(ErrorList); ok {
+		return append(list, errs...)
+	}
+	return append(list, err)
 }
 
 func (e *VartableError) Error() string {
@@ -59,3 +130,7 @@ func (e *VartableError) Error() string {
 func (e *ArgError) Error() string {
 	return "Argument error: " + e.reason
 }
+
+func (e *ImportError) Error() string {
+	return "Import error: " + e.reason
+}
@@ -0,0 +1,181 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package fsm implements a simple Finite State Machine which takes operations as
+inputs and updates its state. When the input operations are finished, the
+generated instructions can be dumped to byte string.
+*/
+package fsm
+
+import (
+	"math"
+	"compiler/operation"
+	"compiler/transformer"
+)
+
+// FSM.Evaluate resolves a value of type FLOAT, VARIABLE or EXPRESSION into
+// a number. Variables are looked up in the variable table, and must not be
+// transforms or points. A result which is infinite or not a number is reported as an
+// error instead of being carried on.
+func (fsm *FSM) Evaluate(v operation.Value) (float64, error) {
+	switch v.Type {
+	case operation.FLOAT:
+		return v.Number, nil
+	case operation.VARIABLE:
+		value, ok := fsm.Lookup(v.Name)
+		if !ok {
+			return 0, NewVartableError("undefined variable: " + v.Name)
+		}
+		if value.Type != operation.FLOAT {
+			return 0, NewVartableError(v.Name + " is not number")
+		}
+		return value.Number, nil
+	case operation.EXPRESSION:
+		return fsm.evaluateExpression(v.Expr)
+	}
+	return 0, NewVartableError("invalid value type")
+}
+
+// FSM.Resolve is like FSM.Evaluate, except that a variable may also refer to
+// a transform or a point. The result is a value of type FLOAT, TRANSFORMER or
+// PAIR.
+func (fsm *FSM) Resolve(v operation.Value) (operation.Value, error) {
+	switch v.Type {
+	case operation.TRANSFORMER:
+		fallthrough
+	case operation.PAIR:
+		return v, nil
+	case operation.VARIABLE:
+		value, ok := fsm.Lookup(v.Name)
+		if !ok {
+			return value, NewVartableError("undefined variable: " + v.Name)
+		}
+		return value, nil
+	}
+	number, err := fsm.Evaluate(v)
+	return operation.NewNumberValue(number), err
+}
+
+// FSM.LookupTransforms resolves an array of values into transforms, which
+// are either given directly or named by variables
+func (fsm *FSM) LookupTransforms(
+	args []operation.Value) ([]*transformer.Transform, error) {
+	result := make([]*transformer.Transform, len(args))
+	for i, v := range args {
+		value, err := fsm.Resolve(v)
+		if err != nil {
+			return result, err
+		}
+		if value.Type != operation.TRANSFORMER {
+			return result, NewVartableError(v.ToString() + " is not transform")
+		}
+		result[i] = value.Transform
+	}
+	return result, nil
+}
+
+// FSM.LookupPoints resolves an array of values into the coordinates of
+// points, which are named by variables
+func (fsm *FSM) LookupPoints(args []operation.Value) ([][]float64, error) {
+	result := make([][]float64, len(args))
+	for i, v := range args {
+		value, err := fsm.Resolve(v)
+		if err != nil {
+			return result, err
+		}
+		if value.Type != operation.PAIR {
+			return result, NewVartableError(v.ToString() + " is not point")
+		}
+		result[i] = value.Point
+	}
+	return result, nil
+}
+
+// FSM.evaluateExpression evaluates an expression tree. Comparisons and
+// boolean operators give 1 for true and 0 for false, and any nonzero number
+// counts as true. The right operand of && and || is only evaluated if needed.
+func (fsm *FSM) evaluateExpression(e *operation.Expression) (float64, error) {
+	var left float64
+	var err error
+	if e.Left != nil {
+		left, err = fsm.Evaluate(*e.Left)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if e.Operator == operation.AND && left == 0 {
+		return 0, nil
+	}
+	if e.Operator == operation.OR && left != 0 {
+		return 1, nil
+	}
+	right, err := fsm.Evaluate(*e.Right)
+	if err != nil {
+		return 0, err
+	}
+	var result float64
+	switch e.Operator {
+	case operation.PLUS:
+		result = left + right
+	case operation.MINUS:
+		result = left - right
+	case operation.TIMES:
+		result = left * right
+	case operation.DIVIDE:
+		if right == 0 {
+			return 0, NewArgError("division by zero in " + e.ToString())
+		}
+		result = left / right
+	case operation.MODULO:
+		if right == 0 {
+			return 0, NewArgError("division by zero in " + e.ToString())
+		}
+		result = math.Mod(left, right)
+	case operation.NEGATE:
+		result = -right
+	case operation.LESS:
+		result = boolToInt(left < right)
+	case operation.LESS_EQUAL:
+		result = boolToInt(left <= right)
+	case operation.GREATER:
+		result = boolToInt(left > right)
+	case operation.GREATER_EQUAL:
+		result = boolToInt(left >= right)
+	case operation.EQUAL:
+		result = boolToInt(left == right)
+	case operation.NOT_EQUAL:
+		result = boolToInt(left != right)
+	case operation.AND:
+		fallthrough
+	case operation.OR:
+		result = boolToInt(right != 0)
+	case operation.NOT:
+		result = boolToInt(right == 0)
+	default:
+		return 0, NewArgError("invalid operator in " + e.ToString())
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, NewArgError("overflow in " + e.ToString())
+	}
+	return result, nil
+}
+
+func boolToInt(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
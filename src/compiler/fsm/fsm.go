@@ -27,16 +27,43 @@ import (
 	"compiler/transformer"
 )
 
+// MaxDrawDepth limits the nesting of DRAW operations. With conditions a figure
+// may draw itself, and without this limit a recursion that never stops would
+// overflow the stack.
+const MaxDrawDepth = 200
+
+// MaxLoopIterations limits the number of times the body of a FOR loop is run.
+// A tiny step or huge bounds would otherwise keep the compiler busy for good.
+const MaxLoopIterations = 1000000
+
+// MaxExponent limits the exponent of POWER, which is converted to an integer
+const MaxExponent = 1000000
+
+// MaxCurveError is the largest distance, in units, allowed between a curve
+// under a perspective projection and the curves drawn in its place
+const MaxCurveError = 0.1
 
 type FSM struct {
 	tfstack  *transformer.TFStack
 	vartable *VarTable
 	opertable *OperationTable
 	instlist []instruction.Instruction
+	style    *instruction.Style
+	styles   []*instruction.Style
 
 	tmptransform *transformer.Transform
 	current string
+	block *operation.Operation
+	body []operation.Operation
+	elseAt int
+	failed bool
 	beginLevel int
+	depth int
+
+	importer *Importer
+	file string
+	namespace string
+	encoding int16
 
 	Verbose bool
 }
@@ -48,42 +75,98 @@ func NewFSM() *FSM {
 	fsm.tfstack = transformer.NewTFStack()
 	fsm.vartable = NewVarTable()
 	fsm.opertable = NewOperationTable()
+	fsm.importer = NewImporter()
 	return fsm
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 // Methods for FSM class //////////////////////////////////////////////////////
 func (fsm *FSM) appendOperation(oper operation.Operation) {
-	(*fsm.opertable)[fsm.current] = append((*fsm.opertable)[fsm.current],oper)
+	if fsm.current == "" {
+		fsm.body = append(fsm.body, oper)
+		return
+	}
+	figure := (*fsm.opertable)[fsm.current]
+	figure.Operations = append(figure.Operations, oper)
+}
+
+// FSM.qualify gives the name of a figure in the operation table, i.e. the
+// name prefixed by the namespace the FSM works in
+func (fsm *FSM) qualify(name string) string {
+	return fsm.namespace + name
+}
+
+// FSM.recording tells whether the operations are not executed but recorded,
+// either into a figure or into the body of a loop or condition
+func (fsm *FSM) recording() bool {
+	return fsm.current != "" || fsm.block != nil
+}
+
+// FSM.skipBlock starts recording the body of a BEGIN, FOR or IF whose header
+// has the error, which is given back. The body is dropped at its END, rather
+// than run at top level, so that the error is the only one reported.
+func (fsm *FSM) skipBlock(oper operation.Operation, err error) error {
+	fsm.block = &oper
+	fsm.body = []operation.Operation{}
+	fsm.elseAt = -1
+	fsm.failed = true
+	fsm.beginLevel++
+	return err
+}
+
+// FSM.Finish is called when there are no more operations, and reports the
+// blocks that are still not ended
+func (fsm *FSM) Finish() error {
+	if fsm.current != "" {
+		return NewFSMError("begin "+fsm.current, "figure not ended").at(
+			(*fsm.opertable)[fsm.current].Pos)
+	}
+	if fsm.block != nil {
+		return NewFSMError(fsm.block.ToString(), "block not ended").at(
+			fsm.block.Pos)
+	}
+	return nil
 }
 
 // FSM.Lookup is a wrapper around the lookup function of its variable table.
 func (fsm *FSM) Lookup(name string) (operation.Value, bool) {
 	value, ok := (*fsm.vartable)[name]
-	return value, ok && (value.Type == operation.INTEGER ||
-		value.Type == operation.TRANSFORMER)
+	return value, ok && (value.Type == operation.FLOAT ||
+		value.Type == operation.TRANSFORMER || value.Type == operation.PAIR)
 }
 
 // FSM.LookupValues takes an array of values which may contain unresolved
-// variables and force them into an array of values of type INTEGER.
+// variables or expressions and evaluates them into an array of numbers.
 // Appearance of other types like TRANSFORMER will cause an error
-func (fsm *FSM) LookupValues(args []operation.Value) ([]int16, error) {
-	result := make([]int16, len(args))
+func (fsm *FSM) LookupValues(args []operation.Value) ([]float64, error) {
+	result := make([]float64, len(args))
 	for i, v := range args {
+		number, err := fsm.Evaluate(v)
+		if err != nil {
+			return result, err
+		}
+		result[i] = number
+	}
+	return result, nil
+}
+
+// FSM.LookupCoords is like FSM.LookupValues, except that a variable may also
+// be a point, which gives its two coordinates
+func (fsm *FSM) LookupCoords(args []operation.Value) ([]float64, error) {
+	result := []float64{}
+	for _, v := range args {
 		if v.Type == operation.VARIABLE {
 			value, ok := fsm.Lookup(v.Name)
-			if !ok {
-				return result, NewVartableError("failed to lookup " + v.Name)
-			}
-			if value.Type != operation.INTEGER {
-				return result, NewVartableError(v.Name + " is not integer")
+			if ok && value.Type == operation.PAIR {
+				result = append(result, value.Point...)
+				continue
 			}
-			result[i] = value.Number
-		} else if v.Type == operation.INTEGER {
-			result[i] = v.Number
-		} else {
-			return result, NewVartableError("invalid value type")
 		}
+		number, err := fsm.Evaluate(v)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, number)
 	}
 	return result, nil
 }
@@ -91,8 +174,9 @@ func (fsm *FSM) LookupValues(args []operation.Value) ([]int16, error) {
 // FSM.ApplyTransform apply the current transformation matrix to the
 // coordinates list. The behavior is different for different drawing types.
 //
-// For LINE, POLYGON, take each pair of integers as (x,y) coordinates
-// and apply the transformation.
+// For LINE, POLYGON, POLYLINE, take each pair of numbers as (x,y) coordinates
+// and apply the transformation. The same for the points of PATH, where the
+// control points of curves are transformed like the others.
 //
 // For RECT and OVAL, some kind of expansion has to be applied to the arguments
 // so that the number of arguments is enough to represent the graph after
@@ -100,11 +184,15 @@ func (fsm *FSM) LookupValues(args []operation.Value) ([]int16, error) {
 //
 // For RECT, finally there will be 4 points stored, i.e. the four vertices
 //
-// For OVAL, finally 8 points are stored in instruction, which is enough to
-// construct an oval after affine transformation using bezier curve
-// TODO: in fact, four points are enough for oval
-func (fsm *FSM) ApplyTransform(coords []int16, command int16) ([]int16, error) {
-	result := make([]int16, len(coords))
+// For OVAL, the centre and two conjugate semi-diameters of the transformed
+// ellipse are stored, which determine it exactly, see Ellipse in transformer
+//
+// A CIRCLE is an OVAL with equal radii, and NGON and STARPOLY are the
+// POLYGONs through their vertices. ARC, SECTOR, ELLIPTICARC and
+// ROUNDRECT are made into the arguments of a PATH, with their curves as
+// Bézier curves, whose control points are transformed.
+func (fsm *FSM) ApplyTransform(coords []float64, command int16) ([]float64, error) {
+	result := make([]float64, len(coords))
 	copy(result, coords)
 	switch command {
 	case operation.RECT:
@@ -112,20 +200,19 @@ func (fsm *FSM) ApplyTransform(coords []int16, command int16) ([]int16, error) {
 			return result, NewArgError(
 				"invalid number of coordinates: " + strconv.Itoa(len(coords)))
 		}
-		result = make([]int16, 8)
-		x1, y1, x2, y2 := float64(coords[0]), float64(coords[1]),
-											float64(coords[2]), float64(coords[3])
-		fx,fy := fsm.tfstack.GetTransform().Apply(float64(x1), float64(y1))
-		result[0], result[1] = int16(fx), int16(fy)
-		fx,fy = fsm.tfstack.GetTransform().Apply(float64(x1), float64(y2))
-		result[2], result[3] = int16(fx), int16(fy)
-		fx,fy = fsm.tfstack.GetTransform().Apply(float64(x2), float64(y2))
-		result[4], result[5] = int16(fx), int16(fy)
-		fx,fy = fsm.tfstack.GetTransform().Apply(float64(x2), float64(y1))
-		result[6], result[7] = int16(fx), int16(fy)
+		result = make([]float64, 8)
+		x1, y1, x2, y2 := coords[0], coords[1], coords[2], coords[3]
+		result[0], result[1] = fsm.tfstack.GetTransform().Apply(x1, y1)
+		result[2], result[3] = fsm.tfstack.GetTransform().Apply(x1, y2)
+		result[4], result[5] = fsm.tfstack.GetTransform().Apply(x2, y2)
+		result[6], result[7] = fsm.tfstack.GetTransform().Apply(x2, y1)
 		return result,nil
 	case operation.LINE:
 		fallthrough
+	case operation.TEXT:
+		fallthrough
+	case operation.POLYLINE:
+		fallthrough
 	case operation.POLYGON:
 		if len(coords) == 0 || len(coords)%2 == 1 {
 			return result, NewArgError(
@@ -133,46 +220,132 @@ func (fsm *FSM) ApplyTransform(coords []int16, command int16) ([]int16, error) {
 		}
 		for i := 0; i < len(coords)/2; i++ {
 			ix, iy := 2*i, 2*i+1
-			x, y := coords[ix], coords[iy]
-			fx, fy := fsm.tfstack.GetTransform().Apply(float64(x), float64(y))
-			result[ix], result[iy] = int16(fx), int16(fy)
+			result[ix], result[iy] = fsm.tfstack.GetTransform().Apply(
+				coords[ix], coords[iy])
 		}
 		return result, nil
 	case operation.OVAL:
-		x, y, a, b := float64(coords[0]), float64(coords[1]),
-									float64(coords[2]), float64(coords[3])
-		result = make([]int16,16)
-		tx, ty := x+a, y
-		fx, fy := fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[0], result[1] = int16(fx), int16(fy)
-		tx, ty = x+a, y+b
-		fx, fy = fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[2], result[3] = int16(fx), int16(fy)
-		tx, ty = x, y+b
-		fx, fy = fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[4], result[5] = int16(fx), int16(fy)
-		tx, ty = x-a, y+b
-		fx, fy = fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[6], result[7] = int16(fx), int16(fy)
-		tx, ty = x-a, y
-		fx, fy = fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[8], result[9] = int16(fx), int16(fy)
-		tx, ty = x-a, y-b
-		fx, fy = fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[10], result[11] = int16(fx), int16(fy)
-		tx, ty = x, y-b
-		fx, fy = fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[12], result[13] = int16(fx), int16(fy)
-		tx, ty = x+a, y-b
-		fx, fy = fsm.tfstack.GetTransform().Apply(tx,ty)
-		result[14], result[15] = int16(fx), int16(fy)
+		if len(coords) != 4 {
+			return result, NewArgError(
+				"invalid number of coordinates: " + strconv.Itoa(len(coords)))
+		}
+		x, y, a, b := coords[0], coords[1], coords[2], coords[3]
+		e, ok := fsm.tfstack.GetTransform().ApplyEllipse(
+			transformer.Ellipse{Cx: x, Cy: y, Ux: a, Vy: b})
+		if !ok {
+			return result, NewArgError(
+				"oval is not bounded after the transformation")
+		}
+		result = []float64{e.Cx, e.Cy, e.Ux, e.Uy, e.Vx, e.Vy}
 		return result, nil
+	case operation.CIRCLE:
+		if len(coords) != 3 {
+			return result, NewArgError(
+				"invalid number of coordinates: " + strconv.Itoa(len(coords)))
+		}
+		return fsm.ApplyTransform(
+			[]float64{coords[0], coords[1], coords[2], coords[2]}, operation.OVAL)
+	case operation.NGON:
+		fallthrough
+	case operation.STARPOLY:
+		var points []float64
+		var err error
+		if command == operation.NGON {
+			points, err = ArgsToNgon(coords)
+		} else {
+			points, err = ArgsToStar(coords)
+		}
+		if err != nil {
+			return result, err
+		}
+		return fsm.ApplyTransform(points, operation.POLYGON)
+	case operation.ARC:
+		fallthrough
+	case operation.SECTOR:
+		fallthrough
+	case operation.ELLIPTICARC:
+		fallthrough
+	case operation.ROUNDRECT:
+		if len(coords) != operation.ExpectArgNum(command) {
+			return result, NewArgError(
+				"invalid number of coordinates: " + strconv.Itoa(len(coords)))
+		}
+		var path []float64
+		var err error
+		switch command {
+		case operation.ARC:
+			path, err = ArgsToArc(coords)
+		case operation.SECTOR:
+			path, err = ArgsToSector(coords)
+		case operation.ELLIPTICARC:
+			path, err = ArgsToEllipticArc(coords)
+		default:
+			path, err = ArgsToRoundRect(coords)
+		}
+		if err != nil {
+			return result, err
+		}
+		return fsm.transformPath(path)
+	case operation.PATH:
+		return fsm.transformPath(coords)
 	default:
 		return result, NewArgError(
 			"invalid draw command: " + operation.GetName(command))
 	}
 }
 
+// FSM.transformPath applies the current transformation matrix to the points
+// of the arguments of a PATH, leaving the tags of the segments. Under a
+// perspective projection the image of a curve is not a cubic curve, so it is
+// split into pieces within MaxCurveError of the image.
+func (fsm *FSM) transformPath(path []float64) ([]float64, error) {
+	segments, err := instruction.PathSegments(path)
+	if err != nil {
+		return path, err
+	}
+	tf := fsm.tfstack.GetTransform()
+	result := []float64{}
+	var x, y, startx, starty float64
+	for _, segment := range segments {
+		coords := segment.Coords
+		switch segment.Tag {
+		case instruction.CURVE:
+			pieces, ok := tf.ApplyBezier(
+				append([]float64{x, y}, coords...), MaxCurveError)
+			if !ok {
+				return path, NewArgError(
+					"curve is not bounded after the transformation")
+			}
+			for i := 0; i < len(pieces); i += 6 {
+				result = append(result, float64(instruction.CURVE))
+				result = append(result, pieces[i:i+6]...)
+			}
+			// Splitting lengthens the path, stop before it no longer fits
+			if len(result) > maxCoords(fsm.encoding) {
+				return path, NewArgError(
+					"too many coordinates after splitting curves: more than " +
+						strconv.Itoa(maxCoords(fsm.encoding)))
+			}
+		default:
+			result = append(result, float64(segment.Tag))
+			for i := 0; i+1 < len(coords); i += 2 {
+				px, py := tf.Apply(coords[i], coords[i+1])
+				result = append(result, px, py)
+			}
+		}
+		switch segment.Tag {
+		case instruction.MOVE:
+			startx, starty = coords[0], coords[1]
+			fallthrough
+		case instruction.LINE_STRIP, instruction.CURVE:
+			x, y = coords[len(coords)-2], coords[len(coords)-1]
+		case instruction.CYCLE:
+			x, y = startx, starty
+		}
+	}
+	return result, nil
+}
+
 func (fsm *FSM) PushTransform(tf *transformer.Transform) {
 	fsm.tfstack.PushTransform(tf)
 }
@@ -188,6 +361,26 @@ func (fsm *FSM) Assign(name string, v operation.Value) error {
 	return fsm.vartable.Assign(name,v)
 }
 
+// FSM.SetEncoding chooses the encoding of coordinates in the dumped
+// instructions, see instruction.WORD16 and WORD32. Every coordinate drawn is
+// checked to fit in it.
+func (fsm *FSM) SetEncoding(encoding int16) {
+	fsm.encoding = encoding
+}
+
+// FSM.DumpInstructions gives the bare instructions, without the header of
+// a .anm file
 func (fsm *FSM) DumpInstructions() []byte {
-	return instruction.InstructionsToBytes(fsm.instlist)
+	return instruction.EncodeInstructions(fsm.instlist, fsm.encoding)
+}
+
+// FSM.DumpFile gives the content of a .anm file with the instructions, see
+// instruction.Header for the layout. The metadata must be within
+// instruction.MaxMetadata.
+func (fsm *FSM) DumpFile(metadata map[string]string) ([]byte, error) {
+	header := instruction.NewHeader(fsm.encoding)
+	for key, value := range metadata {
+		header.Metadata[key] = value
+	}
+	return instruction.EncodeFile(header, fsm.instlist)
 }
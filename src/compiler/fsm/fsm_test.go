@@ -15,7 +15,30 @@
 package fsm
 
 import "testing"
+import "bytes"
+import "io"
+import "math"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strconv"
+import "strings"
+import "compiler/instruction"
 import "compiler/operation"
+import "compiler/transformer"
+
+// argsEqual compares the coordinates of instructions up to rounding errors
+func argsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
 
 func TestFSMUpdate(t *testing.T) {
 	fsm := NewFSM()
@@ -31,7 +54,7 @@ func TestFSMUpdate(t *testing.T) {
 		"set Carror -10",
 		"set Bob Carror",
 		"set Carror Alice",
-		"transform T Alice 0 Bob 0 110 Carror",
+		"transform T Alice/100 0 Bob 0 1.1 Carror",
 		"rotate X Alice",
 		"scale Y Bob Carror",
 		"translate W Bob Carror",
@@ -65,7 +88,7 @@ func TestFSMUpdate(t *testing.T) {
 		"polygon 110 100 0 10 210 220",
 		"oval 110 110 100 50",
 	}
-	results := map[string]int16{
+	results := map[string]float64{
 		"Alice": 110, "Bob": -10, "Carror": 110,
 	}
 	transforms := []string{
@@ -78,11 +101,11 @@ func TestFSMUpdate(t *testing.T) {
 		parser := operation.NewLineParser()
 		oper, err := parser.ParseLine(line)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 		err = fsm.Update(oper)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 	}
 	for k, v := range results {
@@ -91,7 +114,7 @@ func TestFSMUpdate(t *testing.T) {
 			t.Errorf("%s not found", k)
 		}
 		if value.Number != v {
-			t.Errorf("Expect %s = %d, got %d", k, v, value.Number)
+			t.Errorf("Expect %s = %g, got %g", k, v, value.Number)
 		}
 	}
 	for _, v := range unexpect {
@@ -110,3 +133,1463 @@ func TestFSMUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestFSMExpression(t *testing.T) {
+	fsm := NewFSM()
+	tests := []string{
+		"set x 10",
+		"set w 25",
+		"set r x+w",
+		"set r2 r*2",
+		"set q (r2 - x)/3",
+		"set m -r%4",
+		"set n -(x*w)",
+		"line x 0 x+w (r2-5)",
+		"set h w/2",
+		"set p h*0.1",
+	}
+	results := map[string]float64{
+		"r": 35, "r2": 70, "q": 20, "m": -3, "n": -250, "h": 12.5, "p": 1.25,
+	}
+	for _, line := range tests {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for k, v := range results {
+		value, ok := fsm.Lookup(k)
+		if !ok {
+			t.Errorf("%s not found", k)
+		}
+		if value.Number != v {
+			t.Errorf("Expect %s = %g, got %g", k, v, value.Number)
+		}
+	}
+	if len(fsm.instlist) != 1 ||
+		!argsEqual(fsm.instlist[0].Args, []float64{10, 0, 35, 65}) {
+		t.Errorf("Wrong instructions generated: %v", fsm.instlist)
+	}
+
+	invalids := []string{
+		"set a nothere+1",
+		"set a x/0",
+		"set a x%(w-w)",
+		"set big 1" + strings.Repeat("0", 200) + "\nset a big*big",
+		"translate T 1 1\nset a T+1",
+		"line 0 0 x+y 0",
+	}
+	for _, lines := range invalids {
+		var err error
+		for _, line := range strings.Split(lines, "\n") {
+			parser := operation.NewLineParser()
+			var oper operation.Operation
+			oper, err = parser.ParseLine(line)
+			if err != nil {
+				t.Error(err)
+			}
+			err = fsm.Update(oper)
+		}
+		if err == nil {
+			t.Errorf("Expect error for [%s]", lines)
+		}
+	}
+}
+
+func TestFSMFigureParameters(t *testing.T) {
+	fsm := NewFSM()
+	tests := []string{
+		"begin box w h=w",
+		"rect 0 0 w h",
+		"end",
+		"begin moved T s=1",
+		"push T",
+		"line 0 0 s s",
+		"pop",
+		"end",
+		"set a 5",
+		"draw box 10",
+		"draw box a a*4",
+		"translate T 5 5",
+		"draw moved T",
+		"draw moved T a+a",
+	}
+	expects := [][]float64{
+		{0, 0, 0, 10, 10, 10, 10, 0},
+		{0, 0, 0, 20, 5, 20, 5, 0},
+		{5, 5, 6, 6},
+		{5, 5, 15, 15},
+	}
+	for _, line := range tests {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %d", len(expects), len(fsm.instlist))
+	}
+	for i, inst := range fsm.instlist {
+		if !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect instruction %d to be %v, got %v",
+				i, expects[i], inst.Args)
+		}
+	}
+
+	invalids := []string{
+		"draw box",
+		"draw box 1 2 3",
+		"draw box nothere",
+		"draw moved 1",
+		"begin dup x x",
+	}
+	for _, line := range invalids {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err == nil {
+			t.Errorf("Expect error for [%s]", line)
+		}
+	}
+}
+
+func TestFSMLoop(t *testing.T) {
+	fsm := NewFSM()
+	tests := []string{
+		"for i 1 3",
+		"line 0 i i 0",
+		"end",
+		"begin grid n",
+		"for i 0 (n-1)",
+		"for j 4 0 -4",
+		"line i j i j",
+		"end",
+		"end",
+		"end",
+		"set k 0",
+		"for i 10 1 -3",
+		"set k k+i",
+		"end",
+		"draw grid 2",
+		"for t 0 1 0.5",
+		"line t 0 t 0",
+		"end",
+	}
+	expects := [][]float64{
+		{0, 1, 1, 0},
+		{0, 2, 2, 0},
+		{0, 3, 3, 0},
+		{0, 4, 0, 4},
+		{0, 0, 0, 0},
+		{1, 4, 1, 4},
+		{1, 0, 1, 0},
+		{0, 0, 0, 0},
+		{0.5, 0, 0.5, 0},
+		{1, 0, 1, 0},
+	}
+	for _, line := range tests {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if err := fsm.Finish(); err != nil {
+		t.Error(err)
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %d", len(expects), len(fsm.instlist))
+	}
+	for i, inst := range fsm.instlist {
+		if !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect instruction %d to be %v, got %v",
+				i, expects[i], inst.Args)
+		}
+	}
+	if value, _ := fsm.Lookup("k"); value.Number != 22 {
+		t.Errorf("Expect k = 22, got %g", value.Number)
+	}
+
+	invalids := []string{
+		"for i 0 1 0",
+		"for i 0",
+		"for i 0 x",
+		"for i 0 2\nline 0 0 x 0\nend",
+		"end",
+	}
+	for _, lines := range invalids {
+		// A loop with an error is still recorded up to its end
+		fsm := NewFSM()
+		var err error
+		for _, line := range strings.Split(lines, "\n") {
+			parser := operation.NewLineParser()
+			var oper operation.Operation
+			oper, err = parser.ParseLine(line)
+			if err != nil {
+				t.Error(err)
+			}
+			err = fsm.Update(oper)
+		}
+		if err == nil {
+			t.Errorf("Expect error for [%s]", lines)
+		}
+	}
+
+	fsm = NewFSM()
+	parser := operation.NewLineParser()
+	oper, _ := parser.ParseLine("for i 0 2")
+	fsm.Update(oper)
+	if err := fsm.Finish(); err == nil {
+		t.Errorf("Expect error for loop not ended")
+	}
+}
+
+func TestFSMLoopLimit(t *testing.T) {
+	limit := strconv.Itoa(MaxLoopIterations)
+	tests := map[string]bool{
+		"for i 0 1 0.0000000001":      false,
+		"for i 0 (99999*99999*99999)": false,
+		"for i 0 " + limit:            false,
+		"for i 1 " + limit:            true,
+		"for i 1 -99999":              true,
+	}
+	for line, ok := range tests {
+		fsm := NewFSM()
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err == nil {
+			oper, _ = parser.ParseLine("end")
+			err = fsm.Update(oper)
+		}
+		if ok && err != nil {
+			t.Errorf("Failed to run [%s]: %s", line, err.Error())
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(),
+			"too many iterations")) {
+			t.Errorf("Expect too many iterations for [%s], got %v", line, err)
+		}
+	}
+	// Bounds which are not numbers are not counted
+	for _, bound := range []float64{math.NaN(), math.Inf(1)} {
+		oper := operation.NewOperation(operation.FOR)
+		oper.Name = "i"
+		oper.Args = operation.NewNumberValues(0, bound)
+		err := NewFSM().Update(oper)
+		if err == nil || !strings.Contains(err.Error(), "not finite") {
+			t.Errorf("Expect error for loop to %g, got %v", bound, err)
+		}
+	}
+}
+
+func TestFSMCondition(t *testing.T) {
+	fsm := NewFSM()
+	tests := []string{
+		"set dark 1",
+		"set n 3",
+		"if dark",
+		"line 0 0 1 1",
+		"else",
+		"line 0 0 2 2",
+		"end",
+		"if !dark||n<3",
+		"line 0 0 3 3",
+		"end",
+		"if (n >= 3 && n != 4)",
+		"if n==3",
+		"for i 1 2",
+		"if i%2==0",
+		"line 0 0 i i",
+		"else",
+		"line i i 0 0",
+		"end",
+		"end",
+		"else",
+		"line 0 0 4 4",
+		"end",
+		"end",
+		"begin tree n annotate=0",
+		"line 0 0 0 n",
+		"if n>1",
+		"draw tree (n-1)",
+		"else",
+		"if annotate",
+		"rect 0 0 1 1",
+		"end",
+		"end",
+		"end",
+		"draw tree 2",
+		"draw tree 1 1",
+	}
+	expects := [][]float64{
+		{0, 0, 1, 1},
+		{1, 1, 0, 0},
+		{0, 0, 2, 2},
+		{0, 0, 0, 2},
+		{0, 0, 0, 1},
+		{0, 0, 0, 1},
+		{0, 0, 0, 1, 1, 1, 1, 0},
+	}
+	for _, line := range tests {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if err := fsm.Finish(); err != nil {
+		t.Error(err)
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %d", len(expects), len(fsm.instlist))
+	}
+	for i, inst := range fsm.instlist {
+		if !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect instruction %d to be %v, got %v",
+				i, expects[i], inst.Args)
+		}
+	}
+
+	invalids := []string{
+		"else",
+		"if x",
+		"if 1\nelse\nelse",
+		"for i 1 2\nelse",
+		"begin forever\ndraw forever\nend\ndraw forever",
+	}
+	for _, lines := range invalids {
+		var err error
+		for _, line := range strings.Split(lines, "\n") {
+			parser := operation.NewLineParser()
+			var oper operation.Operation
+			oper, err = parser.ParseLine(line)
+			if err != nil {
+				t.Error(err)
+			}
+			err = fsm.Update(oper)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("Expect error for [%s]", lines)
+		}
+		fsm.block, fsm.body, fsm.failed, fsm.beginLevel = nil, nil, false, 0
+	}
+}
+
+func writeScripts(t *testing.T, dir string, scripts map[string]string) {
+	for name, content := range scripts {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFSMImport(t *testing.T) {
+	dir := t.TempDir()
+	writeScripts(t, dir, map[string]string{
+		"main.adr": "import shapes\nimport arrows\ndraw box 2\ndraw arrow\n",
+		"shapes.adr": "import common\nbegin box w\nrect 0 0 w w\nend\n" +
+			"line 0 0 9 9\n",
+		"lib/arrows.adr": "import common\nbegin arrow\nline 0 0 1 0\nend\n",
+		"lib/common.adr": "begin dot\nline 0 0 0 0\nend\n",
+		"cycle.adr":      "import cycle2\n",
+		"cycle2.adr":     "import cycle\n",
+		"dup.adr":        "import shapes\nbegin box\nend\n",
+		"missing.adr":    "import nothere\n",
+		"broken.adr":     "import bad\n",
+		"lib/bad.adr":    "begin bad\nline 0 0\nend\n",
+		"lib/common":     "begin shadowed\nend\n",
+	})
+
+	fsm := NewFSM()
+	fsm.SetFile(filepath.Join(dir, "main.adr"))
+	fsm.AddSearchPath(filepath.Join(dir, "lib"))
+	if err := fsm.CompileFile(filepath.Join(dir, "main.adr")); err != nil {
+		t.Fatal(err)
+	}
+	expects := [][]float64{
+		{0, 0, 0, 2, 2, 2, 2, 0},
+		{0, 0, 1, 0},
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %d", len(expects), len(fsm.instlist))
+	}
+	for i, inst := range fsm.instlist {
+		if !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect instruction %d to be %v, got %v",
+				i, expects[i], inst.Args)
+		}
+	}
+	for _, name := range []string{"box", "arrow", "dot"} {
+		if _, ok := (*fsm.opertable)[name]; !ok {
+			t.Errorf("Figure %s not imported", name)
+		}
+	}
+	if _, ok := (*fsm.opertable)["shadowed"]; ok {
+		t.Errorf("Expect common.adr to be preferred to common")
+	}
+
+	invalids := map[string]string{
+		"cycle.adr":   "import cycle",
+		"dup.adr":     "already exists",
+		"missing.adr": "cannot find nothere",
+		"broken.adr":  "bad.adr:2",
+	}
+	for name, reason := range invalids {
+		fsm := NewFSM()
+		fsm.SetFile(filepath.Join(dir, name))
+		fsm.AddSearchPath(filepath.Join(dir, "lib"))
+		err := fsm.CompileFile(filepath.Join(dir, name))
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expect error with %s for %s, got %v", reason, name, err)
+		}
+	}
+}
+
+func TestFSMImportNamespace(t *testing.T) {
+	dir := t.TempDir()
+	writeScripts(t, dir, map[string]string{
+		"main.adr": "import arrows as a\nimport boxes as b\nimport arrows\n" +
+			"begin arrow\nline 0 0 3 0\nend\n" +
+			"draw a.arrow\ndraw b.arrow\ndraw b.u.head\ndraw arrow\n",
+		"arrows.adr": "begin head\nline 0 0 1 1\nend\n" +
+			"begin arrow\nline 0 0 1 0\ndraw head\nend\n",
+		"boxes.adr": "import arrows as u\nbegin arrow\nline 0 0 2 0\n" +
+			"draw u.arrow\nend\n",
+		"clash.adr": "import arrows\nimport boxes\n",
+	})
+
+	fsm := NewFSM()
+	fsm.SetFile(filepath.Join(dir, "main.adr"))
+	err := fsm.CompileFile(filepath.Join(dir, "main.adr"))
+	if err == nil || !strings.Contains(err.Error(), "already exists: arrow") {
+		t.Errorf("Expect arrow to clash with the one imported, got %v", err)
+	}
+
+	writeScripts(t, dir, map[string]string{
+		"main.adr": "import arrows as a\nimport boxes as b\n" +
+			"begin arrow\nline 0 0 3 0\nend\n" +
+			"draw a.arrow\ndraw b.arrow\ndraw b.u.head\ndraw arrow\n",
+	})
+	fsm = NewFSM()
+	fsm.SetFile(filepath.Join(dir, "main.adr"))
+	if err := fsm.CompileFile(filepath.Join(dir, "main.adr")); err != nil {
+		t.Fatal(err)
+	}
+	expects := [][]float64{
+		{0, 0, 1, 0},
+		{0, 0, 1, 1},
+		{0, 0, 2, 0},
+		{0, 0, 1, 0},
+		{0, 0, 1, 1},
+		{0, 0, 1, 1},
+		{0, 0, 3, 0},
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %d", len(expects), len(fsm.instlist))
+	}
+	for i, inst := range fsm.instlist {
+		if !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect instruction %d to be %v, got %v",
+				i, expects[i], inst.Args)
+		}
+	}
+	for _, name := range []string{"a.arrow", "a.head", "b.arrow",
+		"b.u.arrow", "b.u.head", "arrow"} {
+		if _, ok := (*fsm.opertable)[name]; !ok {
+			t.Errorf("Figure %s not found", name)
+		}
+	}
+	if _, ok := (*fsm.opertable)["head"]; ok {
+		t.Errorf("Figure head should be in a namespace")
+	}
+
+	fsm = NewFSM()
+	fsm.SetFile(filepath.Join(dir, "clash.adr"))
+	err = fsm.CompileFile(filepath.Join(dir, "clash.adr"))
+	if err == nil || !strings.Contains(err.Error(), "already exists: arrow") {
+		t.Errorf("Expect arrow to clash without namespace, got %v", err)
+	}
+}
+
+func TestFSMErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeScripts(t, dir, map[string]string{
+		"main.adr": "import shapes\nbegin outer\n  for i 1 2\n" +
+			"    draw box 10\n  end\nend\ndraw outer\nline 0 0 1\n" +
+			"pop\nline 0 0 1 1\nbegin open\n",
+		"shapes.adr": "begin box w\nline 0 0 w y\nend\n",
+	})
+	path := filepath.Join(dir, "main.adr")
+	fsm := NewFSM()
+	fsm.SetFile(path)
+	err := fsm.CompileFile(path)
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 4 {
+		t.Fatalf("Expect 4 errors, got %v", err)
+	}
+	expects := []string{
+		filepath.Join(dir, "shapes.adr") + ":2:1: ",
+		path + ":8:11: ",
+		path + ":9:1: ",
+		path + ":11:1: ",
+	}
+	for i, expect := range expects {
+		if !strings.HasPrefix(errs[i].Error(), expect) {
+			t.Errorf("Expect error %d at %s, got %v", i, expect, errs[i])
+		}
+	}
+	e, ok := errs[0].(*FSMError)
+	chain := []Call{
+		{"draw box [10]", operation.Position{File: path, Line: 4, Column: 5}},
+		{"for i [1,2] (i = 1)", operation.Position{File: path, Line: 3, Column: 3}},
+		{"draw outer", operation.Position{File: path, Line: 7, Column: 1}},
+	}
+	if !ok || len(e.Chain) != len(chain) {
+		t.Fatalf("Wrong chain of draws: %v", errs[0])
+	}
+	for i, call := range chain {
+		if e.Chain[i] != call {
+			t.Errorf("Expect %v in the chain, got %v", call, e.Chain[i])
+		}
+	}
+	// The instruction after the errors is still drawn
+	if len(fsm.instlist) != 1 {
+		t.Errorf("Expect 1 instruction, got %d", len(fsm.instlist))
+	}
+}
+
+// A block whose header has an error is skipped up to its end, with no other
+// error
+func TestFSMBlockErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeScripts(t, dir, map[string]string{
+		"main.adr": "for i 0 n\nline 0 0 i 1\nend\n" +
+			"if y\nrect 0 0 1 1\nelse\nline 0 0 1 1\nend\n" +
+			"begin a\nend\nbegin a\nfor i 1 2\nline 0 0 2 2\nend\nend\n" +
+			"line 0 0 3 3\n",
+	})
+	path := filepath.Join(dir, "main.adr")
+	fsm := NewFSM()
+	fsm.SetFile(path)
+	err := fsm.CompileFile(path)
+	errs, ok := err.(ErrorList)
+	expects := []string{path + ":1:1: ", path + ":4:1: ", path + ":11:1: "}
+	if !ok || len(errs) != len(expects) {
+		t.Fatalf("Expect %d errors, got %v", len(expects), err)
+	}
+	for i, expect := range expects {
+		if !strings.HasPrefix(errs[i].Error(), expect) {
+			t.Errorf("Expect error %d at %s, got %v", i, expect, errs[i])
+		}
+	}
+	if len(fsm.instlist) != 1 ||
+		!argsEqual(fsm.instlist[0].Args, []float64{0, 0, 3, 3}) {
+		t.Errorf("Expect only the last line drawn, got %v", fsm.instlist)
+	}
+}
+
+func TestFSMCompileComments(t *testing.T) {
+	dir := t.TempDir()
+	writeScripts(t, dir, map[string]string{
+		"main.adr": "/* a box\n   of size w */\nbegin box w\n" +
+			"\trect 0 0 w w // the whole box\nend\n" +
+			"draw box \\\n  (1 + /* half */ 0.5)\n",
+	})
+	path := filepath.Join(dir, "main.adr")
+	fsm := NewFSM()
+	if err := fsm.CompileFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(fsm.instlist) != 1 ||
+		!argsEqual(fsm.instlist[0].Args,
+			[]float64{0, 0, 0, 1.5, 1.5, 1.5, 1.5, 0}) {
+		t.Errorf("Wrong instructions: %v", fsm.instlist)
+	}
+}
+
+func TestFSMText(t *testing.T) {
+	fsm := NewFSM()
+	parser := operation.NewLineParser()
+	lines := []string{
+		"translate T 100 50",
+		"set x 10",
+		"push T",
+		`text x 2*x "$\alpha$"`,
+		"use T",
+		`text 0 0 "b" anchor=southwest align=right`,
+		"pop",
+	}
+	for _, line := range lines {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err != nil {
+			t.Fatalf("Failed to run [%s]: %s", line, err.Error())
+		}
+	}
+	expects := []instruction.Instruction{
+		{Command: operation.TEXT, Args: []float64{110, 70,
+			float64(instruction.ANCHOR_CENTER),
+			float64(instruction.ALIGN_CENTER)}, Text: `$\alpha$`},
+		{Command: operation.TEXT, Args: []float64{200, 100,
+			float64(instruction.ANCHOR_SOUTH_WEST),
+			float64(instruction.ALIGN_RIGHT)}, Text: "b"},
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %v", len(expects), fsm.instlist)
+	}
+	for i, inst := range fsm.instlist {
+		if inst.Text != expects[i].Text || !argsEqual(inst.Args, expects[i].Args) {
+			t.Errorf("Expect %s, got %s", expects[i].ToString(), inst.ToString())
+		}
+	}
+
+	invalids := map[string]string{
+		`text 0 0 "a" anchor=middle`: "invalid anchor middle",
+		`text 0 0 "a" size=2`:        "unknown option size",
+		`text 0 0 "a" align=(1+1)`:   "invalid option",
+		`text y 0 "a"`:               "undefined variable: y",
+	}
+	for line, reason := range invalids {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = NewFSM().Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expect error with %s for [%s], got %v", reason, line, err)
+		}
+	}
+}
+
+func TestFSMPolyline(t *testing.T) {
+	fsm := NewFSM()
+	parser := operation.NewLineParser()
+	lines := []string{
+		"scale T 2 2",
+		"use T",
+		"polyline 0 0 10 10 20 0 30 10 40 0",
+		"polyline 0 0 10 10",
+	}
+	for _, line := range lines {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err != nil {
+			t.Fatalf("Failed to run [%s]: %s", line, err.Error())
+		}
+	}
+	expects := [][]float64{
+		{10, 0, 0, 20, 20, 40, 0, 60, 20, 80, 0},
+		{4, 0, 0, 10, 10},
+	}
+	for i, inst := range fsm.instlist {
+		if inst.Command != operation.POLYLINE || !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect polyline %v, got %s", expects[i], inst.ToString())
+		}
+	}
+
+	for _, line := range []string{"polyline 0 0", "polyline 0 0 1 1 2"} {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = NewFSM().Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), "invalid number") {
+			t.Errorf("Expect invalid number of arguments for [%s], got %v",
+				line, err)
+		}
+	}
+}
+
+// runLines runs the lines on a new FSM and gives its instructions
+func runLines(t *testing.T, lines ...string) []instruction.Instruction {
+	fsm := NewFSM()
+	parser := operation.NewLineParser()
+	for _, line := range lines {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err != nil {
+			t.Fatalf("Failed to run [%s]: %s", line, err.Error())
+		}
+	}
+	return fsm.instlist
+}
+
+func TestFSMShapes(t *testing.T) {
+	insts := runLines(t, "translate T 10 20", "use T", "circle 0 0 5")
+	if len(insts) != 1 || insts[0].Command != operation.OVAL ||
+		!argsEqual(insts[0].Args, []float64{10, 20, 5, 0, 0, 5}) {
+		t.Errorf("Wrong circle: %v", insts)
+	}
+
+	// A quarter circle is one curve, with the control points along the
+	// tangents
+	k := 100 * 4.0 / 3 * math.Tan(math.Pi/8)
+	insts = runLines(t, "arc 0 0 100 0 90")
+	expect := []float64{10, float64(instruction.MOVE), 100, 0,
+		float64(instruction.CURVE), 100, k, k, 100, 0, 100}
+	if len(insts) != 1 || insts[0].Command != operation.PATH ||
+		!argsEqual(insts[0].Args, expect) {
+		t.Errorf("Expect arc %v, got %v", expect, insts)
+	}
+	// The control points are rotated with the arc
+	rotated := runLines(t, "rotate R 90", "use R", "arc 0 0 100 0 90")
+	turned := runLines(t, "arc 0 0 100 90 180")
+	if !argsEqual(rotated[0].Args, turned[0].Args) {
+		t.Errorf("Expect rotated arc %v, got %v", turned[0].Args, rotated[0].Args)
+	}
+	scaled := runLines(t, "scalexy S 2 1", "use S", "ellipticarc 0 0 20 10 30 -200")
+	wide := runLines(t, "ellipticarc 0 0 40 10 30 -200")
+	if !argsEqual(scaled[0].Args, wide[0].Args) {
+		t.Errorf("Expect scaled arc %v, got %v", wide[0].Args, scaled[0].Args)
+	}
+
+	// Every curve of a full circle is exact in the middle
+	insts = runLines(t, "sector 0 0 100 -45 315")
+	segments, err := instruction.PathSegments(insts[0].Args[1:])
+	if err != nil || len(segments) != 7 ||
+		segments[1].Tag != instruction.LINE_STRIP ||
+		segments[6].Tag != instruction.CYCLE {
+		t.Fatalf("Wrong sector: %v %v", segments, err)
+	}
+	for _, segment := range segments[2:6] {
+		c := segment.Coords
+		x := (insts[0].Args[5] + 3*c[0] + 3*c[2] + c[4]) / 8
+		y := (insts[0].Args[6] + 3*c[1] + 3*c[3] + c[5]) / 8
+		if math.Abs(math.Hypot(x, y)-100) > 1e-9 {
+			t.Errorf("Expect the middle of %v on the circle", c)
+		}
+		insts[0].Args[5], insts[0].Args[6] = c[4], c[5]
+	}
+
+	insts = runLines(t, "roundrect 100 50 0 0 10")
+	segments, err = instruction.PathSegments(insts[0].Args[1:])
+	ends := [][]float64{{10, 0}, {90, 0}, {100, 10}, {100, 40}, {90, 50},
+		{10, 50}, {0, 40}, {0, 10}, {10, 0}}
+	if err != nil || len(segments) != 10 {
+		t.Fatalf("Wrong rounded rectangle: %v %v", segments, err)
+	}
+	for i, end := range ends {
+		c := segments[i].Coords
+		if !argsEqual(c[len(c)-2:], end) {
+			t.Errorf("Expect segment %d of rounded rectangle to end at %v, got %v",
+				i, end, c)
+		}
+	}
+
+	invalids := map[string]string{
+		"arc 0 0 10 0 400":      "longer than a full turn",
+		"sector 0 0 10 90 -300": "longer than a full turn",
+		"roundrect 0 0 1 1 -1":  "negative radius",
+		"circle 0 0":            "not finished",
+	}
+	parser := operation.NewLineParser()
+	for line, reason := range invalids {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = NewFSM().Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expect error with %s for [%s], got %v", reason, line, err)
+		}
+	}
+}
+
+func TestFSMRegularPolygons(t *testing.T) {
+	insts := runLines(t, "translate T 100 0", "push T", "ngon 0 0 10 4",
+		"ngon 0 0 10 6 30", "starpoly 0 0 10 5 5 90")
+	c, s := 10*math.Cos(math.Pi/6), 10*math.Sin(math.Pi/6)
+	a := 126.0 / 180 * math.Pi
+	expects := [][]float64{
+		{8, 110, 0, 100, 10, 90, 0, 100, -10},
+		{12, 100 + c, s, 100, 10, 100 - c, s, 100 - c, -s, 100, -10, 100 + c, -s},
+		{20, 100, 10, 100 + 5*math.Cos(a), 5 * math.Sin(a)},
+	}
+	if len(insts) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %v", len(expects), insts)
+	}
+	for i, inst := range insts {
+		expect := expects[i]
+		if inst.Command != operation.POLYGON ||
+			!argsEqual(inst.Args[:len(expect)], expect) {
+			t.Errorf("Expect polygon starting with %v, got %v", expect, inst.Args)
+		}
+	}
+
+	invalids := map[string]string{
+		"ngon 0 0 10":           "expecting centre, radius and number of sides",
+		"ngon 0 0 10 2":         "invalid number of corners 2",
+		"starpoly 0 0 10 5 4.5": "invalid number of corners 4.5",
+		"ngon 0 0 10 4 0 1":     "too many arguments",
+	}
+	parser := operation.NewLineParser()
+	for line, reason := range invalids {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = NewFSM().Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expect error with %s for [%s], got %v", reason, line, err)
+		}
+	}
+}
+
+func TestFSMPoints(t *testing.T) {
+	insts := runLines(t,
+		"point A 0 0",
+		"point B 100 (50*2)",
+		"midpoint M A B",
+		"offset C M 10 -10",
+		"lerp L A B 0.25",
+		"rotate R 90",
+		"apply D R B",
+		"set E D",
+		"line A B",
+		"rect A 10 20",
+		"polygon M C D",
+		"circle E 5",
+		"translate T 5 5",
+		"use T",
+		"line M 0 0",
+		"begin mark p",
+		"line p 0 0",
+		"end",
+		"draw mark L",
+	)
+	expects := []instruction.Instruction{
+		{Command: operation.LINE, Args: []float64{0, 0, 100, 100}},
+		{Command: operation.RECT, Args: []float64{0, 0, 0, 20, 10, 20, 10, 0}},
+		{Command: operation.POLYGON, Args: []float64{6, 50, 50, 60, 40, -100, 100}},
+		{Command: operation.OVAL, Args: []float64{-100, 100, 5, 0, 0, 5}},
+		// The point is kept as it is given, and moved when it is drawn
+		{Command: operation.LINE, Args: []float64{55, 55, 5, 5}},
+		{Command: operation.LINE, Args: []float64{25, 25, 0, 0}},
+	}
+	if len(insts) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %v", len(expects), insts)
+	}
+	for i, inst := range insts {
+		if inst.Command != expects[i].Command ||
+			!argsEqual(inst.Args, expects[i].Args) {
+			t.Errorf("Expect %s, got %s", expects[i].ToString(), inst.ToString())
+		}
+	}
+
+	invalids := map[string]string{
+		"line P 0":        "expecting 4 coordinates, got 3",
+		"line P P P":      "expecting 4 coordinates, got 6",
+		"ngon P 10 5 0 P": "expecting at most 5 coordinates, got 7",
+		"midpoint M P x":  "x is not point",
+		"lerp M P P Q":    "Q is not number",
+		"offset M x 1 1":  "x is not point",
+		"apply M P P":     "P is not transform",
+		"point Q P 1":     "P is not number",
+		"set y x+P":       "P is not number",
+		// H sends the line x+y = 3 to infinity
+		"apply M H F": "point sent to infinity",
+	}
+	parser := operation.NewLineParser()
+	for line, reason := range invalids {
+		fsm := NewFSM()
+		for _, setup := range []string{"point P 1 0", "point Q 0 1",
+			"point F 3 0", "set x 1",
+			"homography H 0 0 1 0 1 1 0 1 -> 0 0 1 0 2 2 0 1"} {
+			oper, _ := parser.ParseLine(setup)
+			if err := fsm.Update(oper); err != nil {
+				t.Fatalf("Failed to run [%s]: %s", setup, err.Error())
+			}
+		}
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expect error with %s for [%s], got %v", reason, line, err)
+		}
+	}
+}
+
+func TestFSMPath(t *testing.T) {
+	fsm := NewFSM()
+	parser := operation.NewLineParser()
+	lines := []string{
+		"translate T 10 20",
+		"push T",
+		"path move 0 0 quad 30 30 60 0 line 60 -30 close " +
+			"cubic 0 10 10 10 10 0",
+		"pop",
+	}
+	for _, line := range lines {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err != nil {
+			t.Fatalf("Failed to run [%s]: %s", line, err.Error())
+		}
+	}
+	// The quadratic curve is raised to a cubic one, and the cubic one after
+	// close starts from the start of the path
+	expect := []float64{21, float64(instruction.MOVE), 10, 20,
+		float64(instruction.CURVE), 30, 40, 50, 40, 70, 20,
+		float64(instruction.LINE_STRIP), 70, -10, float64(instruction.CYCLE),
+		float64(instruction.CURVE), 10, 30, 20, 30, 20, 20}
+	if len(fsm.instlist) != 1 || fsm.instlist[0].Command != operation.PATH ||
+		!argsEqual(fsm.instlist[0].Args, expect) {
+		t.Errorf("Expect path %v, got %v", expect, fsm.instlist)
+	}
+
+	invalids := map[string]string{
+		"path move 0 0 line x 0":     "undefined variable: x",
+		"path move 0 0 line 99999 0": "out of range",
+	}
+	for line, reason := range invalids {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = NewFSM().Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expect error with %s for [%s], got %v", reason, line, err)
+		}
+	}
+}
+
+func TestFSMStyle(t *testing.T) {
+	fsm := NewFSM()
+	parser := operation.NewLineParser()
+	lines := []string{
+		"begin mark",
+		"style fill=yellow",
+		"line 0 0 1 1",
+		"end",
+		"set w 2",
+		"style stroke=red width=w/4",
+		"line 0 0 1 1",
+		"gsave",
+		"style fill=blue dash=dotted opacity=0.5 cap=round join=bevel",
+		"rect 0 0 1 1",
+		"draw mark",
+		"grestore",
+		"text 0 0 \"a\"",
+		"style stroke=black width=0",
+		"line 0 0 1 1",
+		"style arrow=both head=latex",
+		"line 0 0 1 1",
+		"style arrow=none head=to",
+		"line 0 0 1 1",
+	}
+	for _, line := range lines {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err != nil {
+			t.Fatalf("Failed to run [%s]: %s", line, err.Error())
+		}
+	}
+	red := instruction.DefaultStyle()
+	red.Stroke, red.Width = instruction.COLOR_RED, 0.5
+	blue := red
+	blue.Fill, blue.Dash, blue.Opacity = instruction.COLOR_BLUE,
+		instruction.DASH_DOTTED, 0.5
+	blue.Cap, blue.Join = instruction.CAP_ROUND, instruction.JOIN_BEVEL
+	yellow := blue
+	yellow.Fill = instruction.COLOR_YELLOW
+	arrow := instruction.DefaultStyle()
+	arrow.Arrow, arrow.Head = instruction.ARROW_BOTH, instruction.HEAD_LATEX
+	expects := []*instruction.Style{&red, &blue, &yellow, &red, nil, &arrow, nil}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %v", len(expects), fsm.instlist)
+	}
+	for i, inst := range fsm.instlist {
+		if !reflect.DeepEqual(inst.Style, expects[i]) {
+			t.Errorf("Expect style %v of instruction %d, got %v",
+				expects[i], i, inst.Style)
+		}
+	}
+	// The figure changes only its own style
+	if fsm.style != nil {
+		t.Errorf("Expect the default style at the end, got %v", fsm.style)
+	}
+
+	invalids := map[string]string{
+		"style stroke=purplish": "invalid stroke purplish",
+		"style size=2":          "unknown option size",
+		"style dash=(1+1)":      "invalid option",
+		"style width=-1":        "line width -1 out of range",
+		"style arrow=left":      "invalid arrow left",
+		"style head=triangle":   "invalid head triangle",
+		"style opacity=y":       "undefined variable: y",
+		"grestore":              "no graphics state saved",
+	}
+	for line, reason := range invalids {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = NewFSM().Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expect error with %s for [%s], got %v", reason, line, err)
+		}
+	}
+}
+
+// The arrowheads can be read as instructions from the file written
+func TestFSMArrowHeads(t *testing.T) {
+	fsm := NewFSM()
+	parser := operation.NewLineParser()
+	lines := []string{
+		"style arrow=both head=to",
+		"arc 0 0 100 0 90",
+		"style arrow=end head=stealth",
+		"line 0 0 100 0",
+	}
+	for _, line := range lines {
+		oper, err := parser.ParseLine(line)
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err != nil {
+			t.Fatalf("Failed to run [%s]: %s", line, err.Error())
+		}
+	}
+	data, err := fsm.DumpFile(nil)
+	if err != nil {
+		t.Fatalf("Error in DumpFile: %s", err.Error())
+	}
+	r, err := instruction.NewReader(bytes.NewReader(data), instruction.WORD16)
+	if err != nil {
+		t.Fatalf("Error in NewReader: %s", err.Error())
+	}
+	r.SetArrowHeads(10)
+	insts := []instruction.Instruction{}
+	for {
+		inst, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error in Reader.Next: %s", err.Error())
+		}
+		insts = append(insts, inst)
+	}
+	commands := []int16{operation.PATH, operation.POLYLINE, operation.POLYLINE,
+		operation.LINE, operation.POLYGON}
+	// The tip of a to head is its middle point, of a stealth head its first
+	tips := map[int][]float64{1: {100, 0}, 2: {0, 100}, 4: {100, 0}}
+	if len(insts) != len(commands) {
+		t.Fatalf("Expect %d instructions, got %v", len(commands), insts)
+	}
+	for i, inst := range insts {
+		if inst.Command != commands[i] {
+			t.Errorf("Expect %s for instruction %d, got %s",
+				operation.GetName(commands[i]), i, operation.GetName(inst.Command))
+		}
+	}
+	for i, tip := range tips {
+		at := insts[i].Args[1:3]
+		if insts[i].Command == operation.POLYLINE {
+			at = insts[i].Args[3:5]
+		}
+		if !argsEqual(at, tip) {
+			t.Errorf("Expect the tip of instruction %d at %v, got %v",
+				i, tip, insts[i].Args)
+		}
+	}
+}
+
+func TestFSMTransforms(t *testing.T) {
+	fsm := NewFSM()
+	tests := []string{
+		"flipx FX",
+		"flipy FY",
+		"flipxy FXY",
+		"scalex SX 2",
+		"scaley SY 0.5",
+		"scalexy SXY 2 0.5",
+		"translate T 10 0",
+		"rotate R 90",
+		"rotate RF 22.5",
+		"combine TR T R",
+		"combine RT R T",
+		"combine FF FX FY",
+		"invert IT T",
+		"scalexy TS 0.000001 0.000001",
+		"invert ITS TS",
+		"power P3 T 3",
+		"power PN T -2",
+		"power P0 R 0",
+		"shear SH 0.5 0",
+		"rotateabout RA 90 10 10",
+		"mirror M 0 0 10 10",
+		"map AM 0 0 100 0 0 100 -> 20 30 220 30 120 230",
+		"homography H 0 0 100 0 100 100 0 100 -> 10 0 90 0 70 50 30 50",
+	}
+	for _, line := range tests {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	expects := map[string]*transformer.Transform{
+		"FX":  transformer.NewTransform(-1, 0, 0, 0, 1, 0),
+		"FY":  transformer.NewTransform(1, 0, 0, 0, -1, 0),
+		"FXY": transformer.NewTransform(-1, 0, 0, 0, -1, 0),
+		"SX":  transformer.NewTransform(2, 0, 0, 0, 1, 0),
+		"SY":  transformer.NewTransform(1, 0, 0, 0, 0.5, 0),
+		"SXY": transformer.NewTransform(2, 0, 0, 0, 0.5, 0),
+		// Translate first, then rotate: (x,y) -> (-y,x+10)
+		"TR": transformer.NewTransform(0, -1, 0, 1, 0, 10),
+		// Rotate first, then translate: (x,y) -> (10-y,x)
+		"RT": transformer.NewTransform(0, -1, 10, 1, 0, 0),
+		"FF": transformer.NewTransform(-1, 0, 0, 0, -1, 0),
+		"IT": transformer.NewTransform(1, 0, -10, 0, 1, 0),
+		"P3": transformer.NewTransform(1, 0, 30, 0, 1, 0),
+		"PN": transformer.NewTransform(1, 0, -20, 0, 1, 0),
+		"P0": transformer.IdentityTransform(),
+		"RF": transformer.RotateTransform(math.Pi / 8),
+		"SH": transformer.NewTransform(1, 0.5, 0, 0, 1, 0),
+		// (x,y) -> (20-y,x)
+		"RA": transformer.NewTransform(0, -1, 20, 1, 0, 0),
+		"M":  transformer.NewTransform(0, 1, 0, 1, 0, 0),
+		"AM": transformer.NewTransform(2, 1, 20, 0, 2, 30),
+		// A tiny scale can still be undone
+		"ITS": transformer.NewTransform(1e6, 0, 0, 0, 1e6, 0),
+	}
+	for name, expect := range expects {
+		value, ok := fsm.Lookup(name)
+		if !ok || value.Type != operation.TRANSFORMER {
+			t.Errorf("transform %s not found", name)
+			continue
+		}
+		if !value.Transform.Equal(expect) {
+			t.Errorf("Expect %s = %s, got %s",
+				name, expect.ToString(), value.Transform.ToString())
+		}
+	}
+
+	invalids := []string{
+		"combine C T nothere",
+		"set n 1\ncombine C T n",
+		"scalex S nothere",
+		"scalex Z 0\ninvert I Z",
+		"power P Z -1",
+		"power P T nothere",
+		"power P T 1.5",
+		"power P T 10000000000000000000000",
+		"scalexy S2 2 1\npower P S2 10000",
+		"mirror M 5 5 5 5",
+		"map AM 0 0 1 1 2 2 -> 0 0 1 0 0 1",
+		"homography H 0 0 1 0 2 0 0 1 -> 0 0 1 0 1 1 0 1",
+	}
+	for _, lines := range invalids {
+		var err error
+		for _, line := range strings.Split(lines, "\n") {
+			parser := operation.NewLineParser()
+			var oper operation.Operation
+			oper, err = parser.ParseLine(line)
+			if err != nil {
+				t.Error(err)
+			}
+			err = fsm.Update(oper)
+		}
+		if err == nil {
+			t.Errorf("Expect error for [%s]", lines)
+		}
+	}
+}
+
+func TestFSMHomography(t *testing.T) {
+	fsm := NewFSM()
+	tests := []string{
+		"homography H 0 0 100 0 100 100 0 100 -> 10 0 90 0 70 50 30 50",
+		"push H",
+		"rect 0 0 100 100",
+		"line 0 0 50 50",
+		"pop",
+	}
+	for _, line := range tests {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	expects := [][]float64{
+		{10, 0, 30, 50, 70, 50, 90, 0},
+		{10, 0, 50, 100.0 / 3},
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %d", len(expects), len(fsm.instlist))
+	}
+	for i, inst := range fsm.instlist {
+		if !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect instruction %d to be %v, got %v",
+				i, expects[i], inst.Args)
+		}
+	}
+}
+
+// distanceToImage gives about the distance from the point to the image of
+// the circle by the transform
+func distanceToImage(tf *transformer.Transform, cx, cy, r, x, y float64) float64 {
+	d := math.Inf(1)
+	for k := 0; k < 10000; k++ {
+		a := float64(k) * 2 * math.Pi / 10000
+		px, py := tf.Apply(cx+r*math.Cos(a), cy+r*math.Sin(a))
+		d = math.Min(d, math.Hypot(x-px, y-py))
+	}
+	return d
+}
+
+func TestFSMProjectedCurves(t *testing.T) {
+	homography := "homography H 0 0 100 0 100 100 0 100 -> 10 0 90 0 70 50 30 50"
+	insts := runLines(t, homography, "push H", "arc 50 40 30 0 360",
+		"path move 0 0 cubic 0 100 100 100 100 0")
+	if len(insts) != 2 {
+		t.Fatalf("Expect 2 instructions, got %d", len(insts))
+	}
+	segments, err := instruction.PathSegments(insts[0].Args[1:])
+	// The affine image of a full circle is 4 curves
+	if err != nil || len(segments) <= 5 {
+		t.Fatalf("Expect the arc split into more than 4 curves, got %v %v",
+			segments, err)
+	}
+	tf, _ := transformer.HomographyTransform(
+		[4][2]float64{{0, 0}, {100, 0}, {100, 100}, {0, 100}},
+		[4][2]float64{{10, 0}, {90, 0}, {70, 50}, {30, 50}})
+	x, y := segments[0].Coords[0], segments[0].Coords[1]
+	for _, segment := range segments[1:] {
+		c := segment.Coords
+		for _, u := range []float64{0, 0.25, 0.5, 0.75, 1} {
+			v := 1 - u
+			px := v*v*v*x + 3*v*v*u*c[0] + 3*v*u*u*c[2] + u*u*u*c[4]
+			py := v*v*v*y + 3*v*v*u*c[1] + 3*v*u*u*c[3] + u*u*u*c[5]
+			if d := distanceToImage(tf, 50, 40, 30, px, py); d > MaxCurveError {
+				t.Errorf("Expect [%g,%g] on the image of the circle, %g away",
+					px, py, d)
+			}
+		}
+		x, y = c[4], c[5]
+	}
+	segments, err = instruction.PathSegments(insts[1].Args[1:])
+	if err != nil || len(segments) <= 2 {
+		t.Errorf("Expect the curve of the path split, got %v %v", segments, err)
+	}
+
+	// The horizon of the homography is the line y = -100
+	invalids := []string{
+		"arc 50 -90 30 180 360",
+		"path move 0 -90 cubic 0 -110 100 -110 100 -90",
+	}
+	parser := operation.NewLineParser()
+	for _, line := range invalids {
+		fsm := NewFSM()
+		for _, l := range []string{homography, "push H", line} {
+			oper, _ := parser.ParseLine(l)
+			err = fsm.Update(oper)
+		}
+		if err == nil || !strings.Contains(err.Error(), "not bounded") {
+			t.Errorf("Expect curve crossing the horizon to fail for [%s], got %v",
+				line, err)
+		}
+	}
+
+	// A path which fits before its curves are split may not fit after
+	defer func(max int) { instruction.MaxPolygonArgs = max }(
+		instruction.MaxPolygonArgs)
+	instruction.MaxPolygonArgs = 12
+	fsm := NewFSM()
+	for _, l := range []string{homography, "push H",
+		"path move 0 0 cubic 0 100 100 100 100 0"} {
+		oper, _ := parser.ParseLine(l)
+		err = fsm.Update(oper)
+	}
+	if err == nil || !strings.Contains(err.Error(), "after splitting curves") {
+		t.Errorf("Expect the split path to be too long, got %v", err)
+	}
+}
+
+func TestFSMOval(t *testing.T) {
+	fsm := NewFSM()
+	tests := []string{
+		"oval 100 0 50 20",
+		"rotate R 90",
+		"push R",
+		"oval 100 0 50 20",
+		"pop",
+		"shear SH 0.5 0",
+		"push SH",
+		"oval 0 0 100 40",
+		"pop",
+	}
+	for _, line := range tests {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Error(err)
+		}
+		err = fsm.Update(oper)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	// The centre followed by the two conjugate semi-diameters
+	expects := [][]float64{
+		{100, 0, 50, 0, 0, 20},
+		{0, 100, 0, 50, -20, 0},
+		{0, 0, 100, 0, 20, 40},
+	}
+	if len(fsm.instlist) != len(expects) {
+		t.Fatalf("Expect %d instructions, got %d", len(expects), len(fsm.instlist))
+	}
+	for i, inst := range fsm.instlist {
+		if !argsEqual(inst.Args, expects[i]) {
+			t.Errorf("Expect instruction %d to be %v, got %v",
+				i, expects[i], inst.Args)
+		}
+	}
+
+	// The horizon of the homography is the line y = -100, an oval crossing
+	// it has no bounded image
+	invalids := []string{
+		"homography H 0 0 100 0 100 100 0 100 -> 10 0 90 0 70 50 30 50",
+		"push H",
+		"oval 50 -90 30 20",
+	}
+	var err error
+	for _, line := range invalids {
+		parser := operation.NewLineParser()
+		oper, _ := parser.ParseLine(line)
+		err = fsm.Update(oper)
+	}
+	if err == nil {
+		t.Errorf("Expect error for oval crossing the horizon")
+	}
+}
+
+// Long generated drawings are refused with their length, rather than
+// written with a length which does not fit
+func TestFSMLength(t *testing.T) {
+	polygon := "polygon" + strings.Repeat(" 0 0", 16384)
+	path := "path move 0 0" + strings.Repeat(" line 1 1", 11000)
+	for _, line := range []string{polygon, path} {
+		parser := operation.NewLineParser()
+		oper, err := parser.ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, encoding := range []int16{instruction.WORD16, instruction.WORD32} {
+			fsm := NewFSM()
+			fsm.SetEncoding(encoding)
+			err = fsm.Update(oper)
+			if encoding == instruction.WORD16 && (err == nil ||
+				!strings.Contains(err.Error(), "too many coordinates")) {
+				t.Errorf("Expect too many coordinates for %s, got %v",
+					operation.GetName(oper.Command), err)
+			}
+			if encoding == instruction.WORD32 && err != nil {
+				t.Errorf("Unexpected error for %s with 32-bit coordinates: %s",
+					operation.GetName(oper.Command), err.Error())
+			}
+		}
+	}
+}
+
+func TestFSMRange(t *testing.T) {
+	tests := []string{
+		"begin big",
+		"line 0 0 400 0",
+		"end",
+		"scalexy S 100 100",
+		"push S",
+	}
+	invalids := []string{
+		"line 0 0 400 0",
+		"draw big",
+		"oval 0 0 100 400",
+		"line 0 0 (0-400) 327.675",
+	}
+	for _, encoding := range []int16{instruction.WORD16, instruction.WORD32} {
+		fsm := NewFSM()
+		fsm.SetEncoding(encoding)
+		for _, line := range tests {
+			parser := operation.NewLineParser()
+			oper, err := parser.ParseLine(line)
+			if err != nil {
+				t.Error(err)
+			}
+			err = fsm.Update(oper)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		for _, line := range invalids {
+			parser := operation.NewLineParser()
+			oper, err := parser.ParseLine(line)
+			if err != nil {
+				t.Error(err)
+			}
+			err = fsm.Update(oper)
+			if encoding == instruction.WORD16 && err == nil {
+				t.Errorf("Expect error for [%s] with 16-bit coordinates", line)
+			}
+			if encoding == instruction.WORD32 && err != nil {
+				t.Errorf("Unexpected error for [%s] with 32-bit coordinates: %s",
+					line, err.Error())
+			}
+		}
+		if encoding == instruction.WORD32 {
+			insts, err := instruction.DecodeInstructions(
+				fsm.DumpInstructions(), encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(insts) != 4 || !argsEqual(insts[3].Args,
+				[]float64{0, 0, -40000, 32768}) {
+				t.Errorf("Wrong instructions dumped: %v", insts)
+			}
+		}
+	}
+}
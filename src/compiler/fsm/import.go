@@ -0,0 +1,184 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package fsm implements a simple Finite State Machine which takes operations as
+inputs and updates its state. When the input operations are finished, the
+generated instructions can be dumped to byte string.
+*/
+package fsm
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"compiler/operation"
+)
+
+// Importer locates the files to import, and keeps track of the files already
+// imported and the ones being imported. It is shared by all the FSMs working
+// on the same drawing, so that every file is imported only once into each
+// namespace, and import cycles are detected.
+type Importer struct {
+	SearchPath []string
+
+	imported map[importKey]bool
+	stack    []string
+}
+
+type importKey struct {
+	path      string
+	namespace string
+}
+
+func NewImporter() *Importer {
+	importer := new(Importer)
+	importer.imported = map[importKey]bool{}
+	return importer
+}
+
+// Importer.Locate finds the file for import name. The directory of the file
+// containing the import operation is searched first, then the directories in
+// the search path. In each directory, name.adr is preferred to name.
+func (importer *Importer) Locate(name string, from string) (string, error) {
+	dirs := []string{"."}
+	if from != "" {
+		dirs[0] = filepath.Dir(from)
+	}
+	dirs = append(dirs, importer.SearchPath...)
+	for _, dir := range dirs {
+		for _, candidate := range []string{name + ".adr", name} {
+			path := filepath.Join(dir, candidate)
+			info, err := os.Stat(path)
+			if err == nil && !info.IsDir() {
+				return path, nil
+			}
+		}
+	}
+	return "", NewImportError(
+		"cannot find " + name + " in " + strings.Join(dirs, ", "))
+}
+
+// Importer.enter marks a file as being imported, and fails if it is already
+// being imported, i.e. it imports itself directly or indirectly
+func (importer *Importer) enter(path string) error {
+	for i, p := range importer.stack {
+		if p == path {
+			chain := append(append([]string{}, importer.stack[i:]...), path)
+			return NewImportError("import cycle: " + strings.Join(chain, " -> "))
+		}
+	}
+	importer.stack = append(importer.stack, path)
+	return nil
+}
+
+func (importer *Importer) leave(namespace string) {
+	path := importer.stack[len(importer.stack)-1]
+	importer.stack = importer.stack[:len(importer.stack)-1]
+	importer.imported[importKey{path, namespace}] = true
+}
+
+// FSM.SetFile tells the FSM the name of the script file it is compiling, which
+// is needed to locate the files it imports relative to it. The file is also
+// regarded as being imported, so that importing it back is a cycle.
+func (fsm *FSM) SetFile(path string) {
+	fsm.file = path
+	abspath, err := filepath.Abs(path)
+	if err == nil {
+		fsm.importer.stack = []string{abspath}
+	}
+}
+
+// FSM.AddSearchPath appends directories to the search path of import
+func (fsm *FSM) AddSearchPath(dirs ...string) {
+	fsm.importer.SearchPath = append(fsm.importer.SearchPath, dirs...)
+}
+
+// FSM.Import compiles the figures defined in the file for import name into the
+// operation table. Other operations in the file are also run, but in a
+// separate FSM, so their variables and drawings are discarded. Importing a
+// file for the second time into the same namespace does nothing.
+//
+// If alias is not empty, the figures are put in a namespace, i.e. their names
+// are qualified by the alias, like alias.name. Namespaces nest, so if the file
+// imports another file as inner, the figures of the latter are named
+// alias.inner.name
+func (fsm *FSM) Import(name string, alias string) error {
+	path, err := fsm.importer.Locate(name, fsm.file)
+	if err != nil {
+		return err
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return NewImportError(err.Error())
+	}
+	namespace := fsm.namespace
+	if alias != "" {
+		namespace += alias + "."
+	}
+	if fsm.importer.imported[importKey{abspath, namespace}] {
+		return nil
+	}
+	err = fsm.importer.enter(abspath)
+	if err != nil {
+		return err
+	}
+	defer fsm.importer.leave(namespace)
+	subfsm := NewFSM()
+	subfsm.opertable = fsm.opertable
+	subfsm.importer = fsm.importer
+	subfsm.file = path
+	subfsm.namespace = namespace
+	return subfsm.CompileFile(path)
+}
+
+// FSM.CompileFile reads the statements of the script file and updates the
+// FSM with their operations. It goes on after an error, and returns all the
+// errors found as an ErrorList, each with its position in the file.
+func (fsm *FSM) CompileFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return NewImportError(err.Error())
+	}
+
+	errs := ErrorList{}
+	lexer := operation.NewLexer(path, string(data))
+	parser := operation.NewLineParser()
+	for {
+		tokens, err := lexer.Next()
+		if err == io.EOF {
+			break
+		}
+		var oper operation.Operation
+		if err == nil {
+			oper, err = parser.ParseTokens(tokens)
+		}
+		if err == nil {
+			err = fsm.Update(oper)
+		}
+		if err != nil {
+			errs = errs.append(err)
+		}
+	}
+	err = fsm.Finish()
+	if err != nil {
+		errs = errs.append(err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -21,21 +21,81 @@ generated instructions can be dumped to byte string.
 package fsm
 
 import (
+	"strconv"
 	"compiler/operation"
 )
 
-type OperationTable map[string] []operation.Operation
+// Figure is a subfigure defined between BEGIN and END, i.e. the formal
+// parameters given to BEGIN and the list of operations to replay on DRAW.
+// File is the script file where the figure is defined, if known, Pos the
+// position of BEGIN in it, and Namespace the prefix of the names of the
+// figures in that file.
+type Figure struct {
+	Params     []operation.Value
+	Operations []operation.Operation
+	File       string
+	Pos        operation.Position
+	Namespace  string
+}
+
+type OperationTable map[string] *Figure
 
 func NewOperationTable() *OperationTable{
 	return &OperationTable{}
 }
 
+// NewFigure checks the formal parameters and makes an empty figure with them
+func NewFigure(params []operation.Value) (*Figure, error) {
+	names := map[string]bool{}
+	for _, param := range params {
+		name, _ := param.Parameter()
+		if names[name] {
+			return nil, NewArgError("duplicate parameter: " + name)
+		}
+		names[name] = true
+	}
+	return &Figure{params, []operation.Operation{}, "", operation.Position{}, ""}, nil
+}
+
+// FSM.BindArguments assigns the actual arguments of a DRAW operation to the
+// formal parameters of the figure, in the variable table of subfsm. The
+// arguments are evaluated in the scope of fsm, and may be numbers, transforms
+// or points. A parameter without argument takes its default value, which is
+// evaluated in the scope of subfsm, so it may refer to the parameters before.
+func (fsm *FSM) BindArguments(
+	subfsm *FSM, figure *Figure, args []operation.Value) error {
+	if len(args) > len(figure.Params) {
+		return NewArgError("too many arguments: expect at most " +
+			strconv.Itoa(len(figure.Params)) + ", got " + strconv.Itoa(len(args)))
+	}
+	for i, param := range figure.Params {
+		name, def := param.Parameter()
+		var value operation.Value
+		var err error
+		if i < len(args) {
+			value, err = fsm.Resolve(args[i])
+		} else if def != nil {
+			value, err = subfsm.Resolve(*def)
+		} else {
+			return NewArgError("missing argument: " + name)
+		}
+		if err != nil {
+			return err
+		}
+		err = subfsm.Assign(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // VarTable.Assign maps a string to a value. If the value is also a variable,
 // lookup the variable name and map the string to the result found.
 // If failed to find the variable, return an error.
 // 
 // If carried out successfully, the string will point to a value of type
-// INTEGER or TRANSFORMER in this table.
+// FLOAT, TRANSFORMER or PAIR in this table.
 func (vartable *VarTable) Assign(name string, v operation.Value) error {
 	if v.Type == operation.VARIABLE {
 		value, ok := (*vartable)[v.Name]
@@ -44,7 +104,8 @@ func (vartable *VarTable) Assign(name string, v operation.Value) error {
 		}
 		(*vartable)[name] = value
 		return nil
-	} else if v.Type == operation.INTEGER || v.Type == operation.TRANSFORMER {
+	} else if v.Type == operation.FLOAT || v.Type == operation.TRANSFORMER ||
+		v.Type == operation.PAIR {
 		(*vartable)[name] = v
 		return nil
 	}
@@ -22,14 +22,16 @@ package fsm
 
 import (
 	"fmt"
+	"math"
 	"compiler/instruction"
 	"compiler/operation"
+	"compiler/transformer"
 )
 
 /* Update is the most crucial method of FSM: takes an operation and update its
 own state.
 
-For simple drawing operations like LINE, RECT, POLYGON, the FSM
+For simple drawing operations like LINE, RECT, POLYGON, POLYLINE, the FSM
 maps the coordinates using the current transformation matrix in the stack
 and generate an instruction.
 
@@ -37,28 +39,81 @@ For operations like SET, TRANSFORM the FSM modifies its variable lookup
 table.
 
 For operations like USE, PUSH and POP the FSM modifies its matrix stack.
+
+For operations like STYLE, GSAVE and GRESTORE the FSM modifies the style
+given to the instructions, which a figure inherits from where it is drawn.
+
+An error is reported as an FSMError at the position of the operation, or of
+the operation inside a figure or loop where it happens. Errors in an imported
+file come as an ErrorList.
 */
 func (fsm *FSM) Update(oper operation.Operation) error {
+	err := fsm.update(oper)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(ErrorList); ok {
+		return err
+	}
+	e, ok := err.(*FSMError)
+	if !ok {
+		e = NewFSMError(oper.ToString(), err.Error())
+	}
+	return e.at(oper.Pos)
+}
+
+// FSM.update does the work of FSM.Update, without locating the errors
+func (fsm *FSM) update(oper operation.Operation) error {
 	// If there has been a BEGIN not yet ENDed, i.e. in a subfigure, just try to
 	// log the operation into the corresponding operation list of the figure name
-	if fsm.current != "" {
+	// The same for the body of a loop or condition, which is run after its END
+	if fsm.recording() {
 		switch oper.Command {
 		// One more level of begin, doesn't have to evaluate it (that's the job of
 		// the subfigure), but have to count the number of BEGINs to know which END
-		// is the final END
+		// is the final END. Loops and conditions are also ended by END, so count
+		// them as well
 		case operation.BEGIN:
+			fallthrough
+		case operation.FOR:
+			fallthrough
+		case operation.IF:
 			fsm.beginLevel++
 			fsm.appendOperation(oper)
 			return nil
+		// An ELSE on the first level splits the body of the condition being
+		// recorded, deeper ones belong to nested blocks
+		case operation.ELSE:
+			if fsm.beginLevel > 1 || fsm.current != "" || fsm.failed {
+				fsm.appendOperation(oper)
+				return nil
+			}
+			if fsm.block.Command != operation.IF || fsm.elseAt >= 0 {
+				return NewFSMError(oper.ToString(), "unexpected else")
+			}
+			fsm.elseAt = len(fsm.body)
+			return nil
 		// Decrease a level of begin, of there is more than one level
-		// If only one level, end the subfigure
+		// If only one level, end the subfigure, or run the block
 		case operation.END:
 			fsm.beginLevel--
 			if fsm.beginLevel > 0 {
 				fsm.appendOperation(oper)
-			} else if fsm.beginLevel == 0 {
-				fsm.current = ""
 				return nil
+			} else if fsm.beginLevel == 0 {
+				if fsm.current != "" {
+					fsm.current = ""
+					return nil
+				}
+				block, body, failed := *fsm.block, fsm.body, fsm.failed
+				fsm.block, fsm.body, fsm.failed = nil, nil, false
+				if failed {
+					return nil
+				}
+				if block.Command == operation.IF {
+					return fsm.runCondition(block, body, fsm.elseAt)
+				}
+				return fsm.runLoop(block, body)
 			} else {
 				return NewFSMError(oper.ToString(),"too many end operation")
 			}
@@ -77,36 +132,139 @@ func (fsm *FSM) Update(oper operation.Operation) error {
 		fallthrough
 	case operation.OVAL:
 		fallthrough
+	case operation.POLYLINE:
+		fallthrough
+	case operation.CIRCLE:
+		fallthrough
+	case operation.ARC:
+		fallthrough
+	case operation.SECTOR:
+		fallthrough
+	case operation.ELLIPTICARC:
+		fallthrough
+	case operation.ROUNDRECT:
+		fallthrough
+	case operation.NGON:
+		fallthrough
+	case operation.STARPOLY:
+		fallthrough
 	case operation.POLYGON:
-		values, err := fsm.LookupValues(oper.Args)
+		values, err := fsm.LookupCoords(oper.Args)
+		if err == nil {
+			err = checkCoordNum(oper.Command, len(values))
+		}
 		if err != nil {
 			return NewFSMError(
 				oper.ToString(), "invalid drawing arguments: "+err.Error())
 		}
-		hasTmpTransform := fsm.tmptransform != nil
-		if hasTmpTransform {
-			fsm.tfstack.PushTransform(fsm.tmptransform)
-			fsm.tmptransform = nil
+		values, err = fsm.transformCoords(values, oper.Command)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "error in applying transform: "+err.Error())
 		}
-		values, err = fsm.ApplyTransform(values, oper.Command)
-		if hasTmpTransform {
-			fsm.tfstack.PopTransform()
+		inst, err := instruction.GetInstruction(
+			instructionCommand(oper.Command), values)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "error in generating instruction: "+err.Error())
+		}
+		// Catch coordinates blown up by the transforms here, where the
+		// operation is known, rather than letting them wrap in the output
+		err = checkLength(inst, fsm.encoding)
+		if err == nil {
+			err = inst.CheckRange(fsm.encoding)
+		}
+		if err != nil {
+			return NewFSMError(oper.ToString(), err.Error())
+		}
+		inst.Style = fsm.style
+		if fsm.Verbose {
+			fmt.Println(inst.ToString())
+		}
+		fsm.instlist = append(fsm.instlist, inst)
+	case operation.TEXT:
+		if len(oper.Args) < 3 || oper.Args[2].Type != operation.STRING {
+			return NewFSMError(oper.ToString(), "expecting position and string")
 		}
+		values, err := fsm.LookupValues(oper.Args[:2])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid text position: "+err.Error())
+		}
+		anchor, align, err := ArgsToTextOptions(oper.Args[3:])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid text options: "+err.Error())
+		}
+		// Only the anchor point is transformed, the text stays upright
+		values, err = fsm.transformCoords(values, oper.Command)
 		if err != nil {
 			return NewFSMError(
 				oper.ToString(), "error in applying transform: "+err.Error())
 		}
-		inst, err := instruction.GetInstruction(oper.Command, values)
+		inst, err := instruction.NewTextInstruction(
+			values[0], values[1], anchor, align, oper.Args[2].Name)
+		if err == nil {
+			err = inst.CheckRange(fsm.encoding)
+		}
+		if err != nil {
+			return NewFSMError(oper.ToString(), err.Error())
+		}
+		inst.Style = fsm.style
+		if fsm.Verbose {
+			fmt.Println(inst.ToString())
+		}
+		fsm.instlist = append(fsm.instlist, inst)
+	case operation.PATH:
+		tags, coords, err := fsm.lookupPath(oper.Args)
 		if err != nil {
 			return NewFSMError(
-				oper.ToString(), "error in generating instruction: "+err.Error())
+				oper.ToString(), "invalid path arguments: "+err.Error())
 		}
+		inst, err := instruction.NewPathInstruction(tags, coords)
+		if err != nil {
+			return NewFSMError(oper.ToString(), err.Error())
+		}
+		coords, err = fsm.transformCoords(inst.Args[1:], oper.Command)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "error in applying transform: "+err.Error())
+		}
+		inst, err = instruction.GetInstruction(operation.PATH, coords)
+		if err == nil {
+			err = checkLength(inst, fsm.encoding)
+		}
+		if err == nil {
+			err = inst.CheckRange(fsm.encoding)
+		}
+		if err != nil {
+			return NewFSMError(oper.ToString(), err.Error())
+		}
+		inst.Style = fsm.style
 		if fsm.Verbose {
 			fmt.Println(inst.ToString())
 		}
 		fsm.instlist = append(fsm.instlist, inst)
+	case operation.STYLE:
+		style, err := fsm.changeStyle(oper.Args)
+		if err != nil {
+			return NewFSMError(oper.ToString(), "invalid style: "+err.Error())
+		}
+		fsm.style = style
+	case operation.GSAVE:
+		fsm.styles = append(fsm.styles, fsm.style)
+	case operation.GRESTORE:
+		if len(fsm.styles) == 0 {
+			return NewFSMError(oper.ToString(), "no graphics state saved")
+		}
+		fsm.style = fsm.styles[len(fsm.styles)-1]
+		fsm.styles = fsm.styles[:len(fsm.styles)-1]
 	case operation.SET:
-		err := fsm.vartable.Assign(oper.Name, oper.Args[0])
+		value, err := fsm.Resolve(oper.Args[0])
+		if err != nil {
+			return NewFSMError(oper.ToString(), err.Error())
+		}
+		err = fsm.vartable.Assign(oper.Name, value)
 		if err != nil {
 			return NewFSMError(oper.ToString(), err.Error())
 		}
@@ -167,14 +325,217 @@ func (fsm *FSM) Update(oper operation.Operation) error {
 		}
 		fsm.vartable.Assign(
 			oper.Name, operation.NewTransformValue(ArgsToTranslate(tfvalues)))
+	case operation.FLIPX:
+		fsm.vartable.Assign(
+			oper.Name, operation.NewTransformValue(transformer.FlipxTransform()))
+	case operation.FLIPY:
+		fsm.vartable.Assign(
+			oper.Name, operation.NewTransformValue(transformer.FlipyTransform()))
+	case operation.FLIPXY:
+		fsm.vartable.Assign(oper.Name, operation.NewTransformValue(
+			transformer.FlipxTransform().Compose(transformer.FlipyTransform())))
+	case operation.SCALEX:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid scale arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(
+			oper.Name, operation.NewTransformValue(ArgToScaleX(tfvalues[0])))
+	case operation.SCALEY:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid scale arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(
+			oper.Name, operation.NewTransformValue(ArgToScaleY(tfvalues[0])))
+	case operation.SCALEXY:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid scale arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(
+			oper.Name, operation.NewTransformValue(ArgsToScale(tfvalues)))
+	case operation.COMBINE:
+		transforms, err := fsm.LookupTransforms(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid combine arguments: "+err.Error())
+		}
+		// Applying T1 first and then T2 to a vector v means T2(T1 v), so the
+		// matrix of the combination is the product T2 T1
+		fsm.vartable.Assign(oper.Name, operation.NewTransformValue(
+			transforms[1].Compose(transforms[0])))
+	case operation.INVERT:
+		transforms, err := fsm.LookupTransforms(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid invert arguments: "+err.Error())
+		}
+		inverse, ok := transforms[0].Inverse()
+		if !ok {
+			return NewFSMError(oper.ToString(), "transform is singular")
+		}
+		fsm.vartable.Assign(oper.Name, operation.NewTransformValue(inverse))
+	case operation.POWER:
+		transforms, err := fsm.LookupTransforms(oper.Args[:1])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid power arguments: "+err.Error())
+		}
+		exponent, err := fsm.Evaluate(oper.Args[1])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid power arguments: "+err.Error())
+		}
+		if exponent != math.Trunc(exponent) {
+			return NewFSMError(oper.ToString(), "exponent is not an integer")
+		}
+		if math.Abs(exponent) > MaxExponent {
+			return NewFSMError(oper.ToString(), fmt.Sprintf(
+				"exponent %g out of range [%d,%d]",
+				exponent, -MaxExponent, MaxExponent))
+		}
+		power, ok := transforms[0].Power(int(exponent))
+		if !ok {
+			return NewFSMError(oper.ToString(), "transform is singular")
+		}
+		if !power.IsFinite() {
+			return NewFSMError(oper.ToString(), "transform overflows")
+		}
+		fsm.vartable.Assign(oper.Name, operation.NewTransformValue(power))
+	case operation.SHEAR:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid shear arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(
+			oper.Name, operation.NewTransformValue(ArgsToShear(tfvalues)))
+	case operation.ROTATEABOUT:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid rotate arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(
+			oper.Name, operation.NewTransformValue(ArgsToRotateAbout(tfvalues)))
+	case operation.MIRROR:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid mirror arguments: "+err.Error())
+		}
+		mirror, ok := ArgsToMirror(tfvalues)
+		if !ok {
+			return NewFSMError(oper.ToString(), "the two points are the same")
+		}
+		fsm.vartable.Assign(oper.Name, operation.NewTransformValue(mirror))
+	case operation.HOMOGRAPHY:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid homography arguments: "+err.Error())
+		}
+		homography, ok := ArgsToHomography(tfvalues)
+		if !ok {
+			return NewFSMError(oper.ToString(), "three of the points are on a line")
+		}
+		fsm.vartable.Assign(oper.Name, operation.NewTransformValue(homography))
+	case operation.MAP:
+		tfvalues, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid map arguments: "+err.Error())
+		}
+		affine, ok := ArgsToAffineMap(tfvalues)
+		if !ok {
+			return NewFSMError(oper.ToString(), "the points are on a line")
+		}
+		fsm.vartable.Assign(oper.Name, operation.NewTransformValue(affine))
+	case operation.POINT:
+		values, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid point arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(
+			oper.Name, operation.NewPointValue(values[0], values[1]))
+	case operation.MIDPOINT:
+		points, err := fsm.LookupPoints(oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid midpoint arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(oper.Name, lerpPoints(points[0], points[1], 0.5))
+	case operation.OFFSET:
+		points, err := fsm.LookupPoints(oper.Args[:1])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid offset arguments: "+err.Error())
+		}
+		values, err := fsm.LookupValues(oper.Args[1:])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid offset arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(oper.Name, operation.NewPointValue(
+			points[0][0]+values[0], points[0][1]+values[1]))
+	case operation.LERP:
+		points, err := fsm.LookupPoints(oper.Args[:2])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid lerp arguments: "+err.Error())
+		}
+		t, err := fsm.Evaluate(oper.Args[2])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid lerp arguments: "+err.Error())
+		}
+		fsm.vartable.Assign(oper.Name, lerpPoints(points[0], points[1], t))
+	case operation.APPLY:
+		transforms, err := fsm.LookupTransforms(oper.Args[:1])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid apply arguments: "+err.Error())
+		}
+		points, err := fsm.LookupPoints(oper.Args[1:])
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid apply arguments: "+err.Error())
+		}
+		x, y := transforms[0].Apply(points[0][0], points[0][1])
+		if math.IsInf(x, 0) || math.IsInf(y, 0) ||
+			math.IsNaN(x) || math.IsNaN(y) {
+			return NewFSMError(oper.ToString(), "point sent to infinity")
+		}
+		fsm.vartable.Assign(oper.Name, operation.NewPointValue(x, y))
 	case operation.DRAW:
-		operlist,ok := (*fsm.opertable)[oper.Name]
+		figure,ok := (*fsm.opertable)[fsm.qualify(oper.Name)]
 		if !ok {
 			return NewFSMError(
 				oper.ToString(), "figure does not exist: "+oper.Name)
 		}
+		if fsm.depth >= MaxDrawDepth {
+			return NewFSMError(oper.ToString(), "figures nested too deeply, "+
+				"possibly a figure drawing itself without end")
+		}
 		subfsm := NewFSM()
 		subfsm.opertable = fsm.opertable
+		subfsm.depth = fsm.depth + 1
+		subfsm.importer = fsm.importer
+		subfsm.file = figure.File
+		subfsm.namespace = figure.Namespace
+		subfsm.encoding = fsm.encoding
+		subfsm.style = fsm.style
+		err := fsm.BindArguments(subfsm, figure, oper.Args)
+		if err != nil {
+			return NewFSMError(
+				oper.ToString(), "invalid arguments for figure "+oper.Name+": "+
+				err.Error())
+		}
 		hasTmpTransform := fsm.tmptransform != nil
 		if hasTmpTransform {
 			fsm.tfstack.PushTransform(fsm.tmptransform)
@@ -184,29 +545,268 @@ func (fsm *FSM) Update(oper operation.Operation) error {
 		if hasTmpTransform {
 			fsm.tfstack.PopTransform()
 		}
-		for _,suboper := range operlist {
+		for _,suboper := range figure.Operations {
 			if fsm.Verbose {
 				fmt.Printf("Subfigure %s: %s\n",oper.Name,suboper.ToString())
 			}
 			err := subfsm.Update(suboper)
-			if err != nil {
-				return NewFSMError(
-					oper.ToString(),"error in figure "+oper.Name+":\n\t"+err.Error())
+			if e,ok := err.(*FSMError); ok {
+				return e.calledBy(oper.ToString(),oper.Pos)
+			} else if err != nil {
+				return err
 			}
 		}
 		fsm.instlist = append(fsm.instlist,subfsm.instlist...)
 	case operation.IMPORT:
+		alias := ""
+		if len(oper.Args) > 0 {
+			alias = oper.Args[0].Name
+		}
+		err := fsm.Import(oper.Name, alias)
+		if _, ok := err.(ErrorList); ok {
+			return err
+		} else if err != nil {
+			return NewFSMError(oper.ToString(), err.Error())
+		}
 	case operation.BEGIN:
-		_,ok := (*fsm.opertable)[oper.Name]
+		name := fsm.qualify(oper.Name)
+		existing,ok := (*fsm.opertable)[name]
 		if ok {
-			return NewFSMError(
-				oper.ToString(), "figure already exists: "+oper.Name)
+			reason := "figure already exists: "+oper.Name
+			if existing.File != "" {
+				reason += ", defined in "+existing.File
+			}
+			return fsm.skipBlock(oper, NewFSMError(oper.ToString(), reason))
+		}
+		figure,err := NewFigure(oper.Args)
+		if err != nil {
+			return fsm.skipBlock(oper,
+				NewFSMError(oper.ToString(), err.Error()))
+		}
+		figure.File = fsm.file
+		figure.Pos = oper.Pos
+		figure.Namespace = fsm.namespace
+		(*fsm.opertable)[name] = figure
+		fsm.current = name
+		fsm.beginLevel++
+	case operation.FOR:
+		if len(oper.Args) < 2 {
+			return fsm.skipBlock(oper,
+				NewFSMError(oper.ToString(), "expecting from, to and step"))
+		}
+		values, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return fsm.skipBlock(oper, NewFSMError(
+				oper.ToString(), "invalid loop arguments: "+err.Error()))
+		}
+		// A NaN would pass any comparison with the limit below
+		for _, v := range values {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return fsm.skipBlock(oper, NewFSMError(oper.ToString(),
+					fmt.Sprintf("loop argument %g is not finite", v)))
+			}
+		}
+		if len(values) == 3 && values[2] == 0 {
+			return fsm.skipBlock(oper,
+				NewFSMError(oper.ToString(), "step of loop is zero"))
+		}
+		if steps := loopSteps(values); steps > MaxLoopIterations {
+			return fsm.skipBlock(oper, NewFSMError(oper.ToString(), fmt.Sprintf(
+				"too many iterations: %g, at most %d", steps, MaxLoopIterations)))
 		}
-		(*fsm.opertable)[oper.Name] = []operation.Operation{}
-		fsm.current = oper.Name
+		// The bounds are evaluated only once, before the body is recorded
+		loop := oper
+		loop.Args = operation.NewNumberValues(values...)
+		fsm.block = &loop
+		fsm.body = []operation.Operation{}
 		fsm.beginLevel++
+	case operation.IF:
+		// Like loops, the condition is evaluated before the body is recorded
+		values, err := fsm.LookupValues(oper.Args)
+		if err != nil {
+			return fsm.skipBlock(oper, NewFSMError(
+				oper.ToString(), "invalid condition: "+err.Error()))
+		}
+		condition := oper
+		condition.Args = operation.NewNumberValues(values...)
+		fsm.block = &condition
+		fsm.body = []operation.Operation{}
+		fsm.elseAt = -1
+		fsm.beginLevel++
+	case operation.ELSE:
+		return NewFSMError(oper.ToString(),"unexpected else")
 	case operation.END:
 		return NewFSMError(oper.ToString(),"unexpected end of figure")
 	}
 	return nil
 }
+
+// FSM.transformCoords applies the current transform to the coordinates of a
+// drawing operation, together with the transform of a preceding USE, which
+// applies to this operation only
+func (fsm *FSM) transformCoords(
+	coords []float64, command int16) ([]float64, error) {
+	hasTmpTransform := fsm.tmptransform != nil
+	if hasTmpTransform {
+		fsm.tfstack.PushTransform(fsm.tmptransform)
+		fsm.tmptransform = nil
+	}
+	result, err := fsm.ApplyTransform(coords, command)
+	if hasTmpTransform {
+		fsm.tfstack.PopTransform()
+	}
+	return result, err
+}
+
+// FSM.lookupPath evaluates the segments of PATH, as checked by the parser,
+// into the tags of the instruction and the points after them. A quadratic
+// curve is given as the cubic one with the same shape, whose control points
+// are 2/3 of the way from the ends to the control point of the quadratic one.
+func (fsm *FSM) lookupPath(
+	args []operation.Value) ([]int16, []float64, error) {
+	tags, coords := []int16{}, []float64{}
+	var x, y, startx, starty float64
+	for i := 0; i < len(args); {
+		keyword := args[i].Name
+		n, ok := operation.PathSegmentArgs(keyword)
+		if !ok || i+1+n > len(args) {
+			return nil, nil, NewArgError("invalid segment " + args[i].ToString())
+		}
+		values, err := fsm.LookupValues(args[i+1 : i+1+n])
+		if err != nil {
+			return nil, nil, err
+		}
+		i += 1 + n
+		switch keyword {
+		case "move":
+			tags = append(tags, instruction.MOVE)
+			startx, starty = values[0], values[1]
+		case "line":
+			tags = append(tags, instruction.LINE_STRIP)
+		case "quad":
+			cx, cy, ex, ey := values[0], values[1], values[2], values[3]
+			values = []float64{x + 2*(cx-x)/3, y + 2*(cy-y)/3,
+				ex + 2*(cx-ex)/3, ey + 2*(cy-ey)/3, ex, ey}
+			tags = append(tags, instruction.CURVE)
+		case "cubic":
+			tags = append(tags, instruction.CURVE)
+		case "close":
+			// Back at the start of the piece, where a curve after it starts
+			tags = append(tags, instruction.CYCLE)
+			x, y = startx, starty
+			continue
+		}
+		coords = append(coords, values...)
+		x, y = values[len(values)-2], values[len(values)-1]
+	}
+	return tags, coords, nil
+}
+
+// FSM.changeStyle gives the current style changed by the options of STYLE.
+// Colors, dash patterns, caps, joins, arrows and heads are names, which are
+// not looked up as variables, while width and opacity are evaluated.
+func (fsm *FSM) changeStyle(args []operation.Value) (*instruction.Style, error) {
+	style := fsm.style.OrDefault()
+	for _, arg := range args {
+		key, value := arg.Parameter()
+		if value == nil {
+			return nil, NewArgError("invalid option " + arg.ToString())
+		}
+		if key == "width" || key == "opacity" {
+			number, err := fsm.Evaluate(*value)
+			if err != nil {
+				return nil, err
+			}
+			if key == "width" {
+				style.Width = number
+			} else {
+				style.Opacity = number
+			}
+			continue
+		}
+		var code *int16
+		var lookup func(string) (int16, bool)
+		switch key {
+		case "stroke":
+			code, lookup = &style.Stroke, instruction.GetColor
+		case "fill":
+			code, lookup = &style.Fill, instruction.GetColor
+		case "dash":
+			code, lookup = &style.Dash, instruction.GetDash
+		case "cap":
+			code, lookup = &style.Cap, instruction.GetCap
+		case "join":
+			code, lookup = &style.Join, instruction.GetJoin
+		case "arrow":
+			code, lookup = &style.Arrow, instruction.GetArrow
+		case "head":
+			code, lookup = &style.Head, instruction.GetHead
+		default:
+			return nil, NewArgError("unknown option " + key)
+		}
+		if value.Type != operation.VARIABLE {
+			return nil, NewArgError("invalid option " + arg.ToString())
+		}
+		ok := false
+		*code, ok = lookup(value.Name)
+		if !ok {
+			return nil, NewArgError("invalid " + key + " " + value.Name)
+		}
+	}
+	err := style.Check()
+	if err != nil {
+		return nil, err
+	}
+	return style.Ref(), nil
+}
+
+// FSM.runCondition runs the operations of the body before the ELSE if the
+// condition is nonzero, and the ones after otherwise. If there is no ELSE,
+// elseAt is negative.
+func (fsm *FSM) runCondition(
+	condition operation.Operation, body []operation.Operation, elseAt int) error {
+	branch := body
+	if elseAt >= 0 && condition.Args[0].Number != 0 {
+		branch = body[:elseAt]
+	} else if elseAt >= 0 {
+		branch = body[elseAt:]
+	} else if condition.Args[0].Number == 0 {
+		branch = nil
+	}
+	for _, oper := range branch {
+		err := fsm.Update(oper)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FSM.runLoop runs the body of a FOR loop, with the loop variable going from
+// the first bound to the second (inclusively) by the step, which is 1 if not
+// given. The variable is assigned in the variable table of the FSM before
+// each iteration, so it stays there after the loop.
+func (fsm *FSM) runLoop(loop operation.Operation, body []operation.Operation) error {
+	values, _ := operation.ValuesToFloat(loop.Args)
+	from, step := values[0], 1.0
+	if len(values) == 3 {
+		step = values[2]
+	}
+	// The variable is computed from the number of steps taken rather than
+	// accumulated, so that a fractional step does not drift
+	steps := int(loopSteps(values))
+	for k := 0; k < steps; k++ {
+		i := from + float64(k)*step
+		fsm.vartable.Assign(loop.Name, operation.NewNumberValue(i))
+		for _, oper := range body {
+			err := fsm.Update(oper)
+			if e, ok := err.(*FSMError); ok {
+				return e.calledBy(fmt.Sprintf(
+					"%s (%s = %g)", loop.ToString(), loop.Name, i), loop.Pos)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
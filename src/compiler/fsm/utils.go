@@ -21,34 +21,328 @@ generated instructions can be dumped to byte string.
 package fsm
 
 import (
+	"fmt"
 	"math"
+	"compiler/instruction"
+	"compiler/operation"
 	"compiler/transformer"
 )
 
-// ArgsToTransform given an array of six integers returns a transformer
-// The transformer is a matrix of type float64, so to represent a transformer
-// with some accuracy, use 1 in integer to represent 0.01 in float
-func ArgsToTransform(args []int16) *transformer.Transform {
+// ArgsToTransform given an array of six numbers returns a transformer, whose
+// first two rows are the numbers
+func ArgsToTransform(args []float64) *transformer.Transform {
 	return transformer.NewTransform(
-		float64(args[0])/100.0, float64(args[1])/100.0, float64(args[2]),
-		float64(args[3])/100.0, float64(args[4])/100.0, float64(args[5]),
+		args[0], args[1], args[2],
+		args[3], args[4], args[5],
 	)
 }
 
-func ArgToRotate(arg int16) *transformer.Transform {
-	return transformer.RotateTransform(
-		float64(arg)/180.0*math.Pi,
-	)
+// ArgToRotate takes the angle in degrees, which may be fractional
+func ArgToRotate(arg float64) *transformer.Transform {
+	return transformer.RotateTransform(arg / 180.0 * math.Pi)
 }
 
-func ArgsToScale(args []int16) *transformer.Transform {
-	return transformer.ScaleTransform(
-		float64(args[0])/100.0, float64(args[1])/100.0,
-	)
+func ArgsToScale(args []float64) *transformer.Transform {
+	return transformer.ScaleTransform(args[0], args[1])
+}
+
+func ArgToScaleX(arg float64) *transformer.Transform {
+	return transformer.ScaleTransform(arg, 1)
 }
 
-func ArgsToTranslate(args []int16) *transformer.Transform {
-	return transformer.TranslateTransform(
-		float64(args[0]), float64(args[1]),
+func ArgToScaleY(arg float64) *transformer.Transform {
+	return transformer.ScaleTransform(1, arg)
+}
+
+func ArgsToTranslate(args []float64) *transformer.Transform {
+	return transformer.TranslateTransform(args[0], args[1])
+}
+
+func ArgsToShear(args []float64) *transformer.Transform {
+	return transformer.ShearTransform(args[0], args[1])
+}
+
+func ArgsToRotateAbout(args []float64) *transformer.Transform {
+	return transformer.RotateAboutTransform(
+		args[0]/180.0*math.Pi, args[1], args[2],
 	)
 }
+
+func ArgsToMirror(args []float64) (*transformer.Transform, bool) {
+	return transformer.MirrorTransform(args[0], args[1], args[2], args[3])
+}
+
+func ArgsToHomography(args []float64) (*transformer.Transform, bool) {
+	var src, dst [4][2]float64
+	for i := 0; i < 4; i++ {
+		src[i][0], src[i][1] = args[2*i], args[2*i+1]
+		dst[i][0], dst[i][1] = args[2*i+8], args[2*i+9]
+	}
+	return transformer.HomographyTransform(src, dst)
+}
+
+func ArgsToAffineMap(args []float64) (*transformer.Transform, bool) {
+	var src, dst [3][2]float64
+	for i := 0; i < 3; i++ {
+		src[i][0], src[i][1] = args[2*i], args[2*i+1]
+		dst[i][0], dst[i][1] = args[2*i+6], args[2*i+7]
+	}
+	return transformer.AffineMapTransform(src, dst)
+}
+
+// ArgsToTextOptions takes the options of TEXT, like anchor=north and
+// align=left, and gives the anchor and the alignment, which are center if not
+// given. The values are names, which are not looked up as variables.
+func ArgsToTextOptions(args []operation.Value) (int16, int16, error) {
+	anchor, align := instruction.ANCHOR_CENTER, instruction.ALIGN_CENTER
+	for _, arg := range args {
+		key, value := arg.Parameter()
+		if key != "anchor" && key != "align" {
+			return anchor, align, NewArgError("unknown option " + key)
+		}
+		if value == nil || value.Type != operation.VARIABLE {
+			return anchor, align, NewArgError("invalid option " + arg.ToString())
+		}
+		ok := false
+		if key == "anchor" {
+			anchor, ok = instruction.GetAnchor(value.Name)
+		} else {
+			align, ok = instruction.GetAlign(value.Name)
+		}
+		if !ok {
+			return anchor, align, NewArgError("invalid " + key + " " + value.Name)
+		}
+	}
+	return anchor, align, nil
+}
+
+// MaxArcDegrees is the longest arc, a full turn, so that a wrong angle does
+// not make a path of countless curves
+const MaxArcDegrees = 360
+
+// instructionCommand gives the instruction a drawing operation is compiled
+// to. A circle is an OVAL, regular polygons and stars are POLYGONs, and the
+// other shapes are PATHs of Bézier curves.
+func instructionCommand(command int16) int16 {
+	switch command {
+	case operation.CIRCLE:
+		return operation.OVAL
+	case operation.NGON, operation.STARPOLY:
+		return operation.POLYGON
+	case operation.ARC, operation.SECTOR, operation.ELLIPTICARC,
+		operation.ROUNDRECT:
+		return operation.PATH
+	}
+	return command
+}
+
+// ellipseArc appends to the arguments of a PATH the curves along the ellipse
+// with centre (cx,cy) and semi-axes rx, ry from the angle start to end, in
+// degrees, starting from the point at start. Each curve covers at most 90
+// degrees, and its control points are along the tangents at the ends, at
+// 4/3 tan(d/4) of the derivative for an angle d, which is exact at the ends
+// and the middle and differs by less than 0.03% of the radius elsewhere.
+func ellipseArc(path []float64, cx, cy, rx, ry, start, end float64) []float64 {
+	n := int(math.Ceil(math.Abs(end-start) / 90))
+	d := (end - start) / float64(n) / 180 * math.Pi
+	k := 4.0 / 3 * math.Tan(d/4)
+	a := start / 180 * math.Pi
+	for i := 0; i < n; i++ {
+		b := a + d
+		path = append(path, float64(instruction.CURVE),
+			cx+rx*(math.Cos(a)-k*math.Sin(a)), cy+ry*(math.Sin(a)+k*math.Cos(a)),
+			cx+rx*(math.Cos(b)+k*math.Sin(b)), cy+ry*(math.Sin(b)-k*math.Cos(b)),
+			cx+rx*math.Cos(b), cy+ry*math.Sin(b))
+		a = b
+	}
+	return path
+}
+
+// checkArc checks the angles of an arc, which may go either way
+func checkArc(start, end float64) error {
+	if !(math.Abs(end-start) <= MaxArcDegrees) {
+		return NewArgError(fmt.Sprintf(
+			"arc from %g to %g degrees longer than a full turn", start, end))
+	}
+	return nil
+}
+
+// ArgsToEllipticArc gives the arguments of a PATH along the ellipse from
+// cx cy rx ry start end, starting with a move to the point at start
+func ArgsToEllipticArc(args []float64) ([]float64, error) {
+	cx, cy, rx, ry, start, end := args[0], args[1], args[2], args[3],
+		args[4], args[5]
+	err := checkArc(start, end)
+	if err != nil {
+		return nil, err
+	}
+	a := start / 180 * math.Pi
+	path := []float64{float64(instruction.MOVE),
+		cx + rx*math.Cos(a), cy + ry*math.Sin(a)}
+	return ellipseArc(path, cx, cy, rx, ry, start, end), nil
+}
+
+// ArgsToArc gives the PATH along the circle from cx cy r start end
+func ArgsToArc(args []float64) ([]float64, error) {
+	return ArgsToEllipticArc(
+		[]float64{args[0], args[1], args[2], args[2], args[3], args[4]})
+}
+
+// ArgsToSector gives the closed PATH of the pie slice from cx cy r start end,
+// from the centre along the arc and back
+func ArgsToSector(args []float64) ([]float64, error) {
+	cx, cy, r, start, end := args[0], args[1], args[2], args[3], args[4]
+	err := checkArc(start, end)
+	if err != nil {
+		return nil, err
+	}
+	a := start / 180 * math.Pi
+	path := []float64{float64(instruction.MOVE), cx, cy,
+		float64(instruction.LINE_STRIP), cx + r*math.Cos(a), cy + r*math.Sin(a)}
+	path = ellipseArc(path, cx, cy, r, r, start, end)
+	return append(path, float64(instruction.CYCLE)), nil
+}
+
+// ArgsToRoundRect gives the closed PATH of the rectangle from x1 y1 x2 y2
+// with the corners rounded by quarter circles of radius r, which is made
+// smaller if the sides are too short for it
+func ArgsToRoundRect(args []float64) ([]float64, error) {
+	x1, y1 := math.Min(args[0], args[2]), math.Min(args[1], args[3])
+	x2, y2 := math.Max(args[0], args[2]), math.Max(args[1], args[3])
+	r := args[4]
+	if !(r >= 0) {
+		return nil, NewArgError(fmt.Sprintf("negative radius %g", r))
+	}
+	r = math.Min(r, math.Min(x2-x1, y2-y1)/2)
+	line := float64(instruction.LINE_STRIP)
+	path := []float64{float64(instruction.MOVE), x1 + r, y1, line, x2 - r, y1}
+	path = ellipseArc(path, x2-r, y1+r, r, r, 270, 360)
+	path = append(path, line, x2, y2-r)
+	path = ellipseArc(path, x2-r, y2-r, r, r, 0, 90)
+	path = append(path, line, x1+r, y2)
+	path = ellipseArc(path, x1+r, y2-r, r, r, 90, 180)
+	path = append(path, line, x1, y1+r)
+	path = ellipseArc(path, x1+r, y1+r, r, r, 180, 270)
+	return append(path, float64(instruction.CYCLE)), nil
+}
+
+// regularPoints gives the n points on the circle around (cx,cy) with radius
+// r, the first at the angle rotation in degrees and the others following it
+// counterclockwise at equal angles
+func regularPoints(cx, cy, r float64, n int, rotation float64) []float64 {
+	ret := make([]float64, 0, 2*n)
+	for i := 0; i < n; i++ {
+		a := (rotation + 360*float64(i)/float64(n)) / 180 * math.Pi
+		ret = append(ret, cx+r*math.Cos(a), cy+r*math.Sin(a))
+	}
+	return ret
+}
+
+// maxCoords gives the largest number of words after the length of a
+// POLYGON, POLYLINE or PATH, which is what a decoder accepts and fits in the
+// length word of the encoding
+func maxCoords(encoding int16) int {
+	_, max := instruction.CoordRange(encoding)
+	return int(math.Min(float64(instruction.MaxPolygonArgs), max))
+}
+
+// checkLength reports an instruction of variable length which is longer than
+// maxCoords, which would otherwise be written and then refused when read
+func checkLength(inst instruction.Instruction, encoding int16) error {
+	if operation.GetType(inst.Command) != operation.DRAW_UNDETERMINED {
+		return nil
+	}
+	if n := len(inst.Args) - 1; n > maxCoords(encoding) {
+		return NewArgError(fmt.Sprintf(
+			"too many coordinates: %d, at most %d", n, maxCoords(encoding)))
+	}
+	return nil
+}
+
+// checkCorners checks that the number of corners of a regular polygon or
+// star is a whole number from 3, and small enough for a polygon
+func checkCorners(n float64, points int) error {
+	if n != math.Trunc(n) || n < 3 ||
+		n*float64(points) > float64(instruction.MaxPolygonArgs) {
+		return NewArgError(fmt.Sprintf("invalid number of corners %g", n))
+	}
+	return nil
+}
+
+// ArgsToNgon gives the vertices of the regular polygon from cx cy r n and an
+// optional rotation, where the first vertex is at the angle rotation, 0 by
+// default
+func ArgsToNgon(args []float64) ([]float64, error) {
+	if len(args) < 4 {
+		return nil, NewArgError("expecting centre, radius and number of sides")
+	}
+	err := checkCorners(args[3], 2)
+	if err != nil {
+		return nil, err
+	}
+	rotation := 0.0
+	if len(args) > 4 {
+		rotation = args[4]
+	}
+	return regularPoints(args[0], args[1], args[2], int(args[3]), rotation), nil
+}
+
+// ArgsToStar gives the vertices of the star from cx cy r1 r2 n and an
+// optional rotation. Its n points are at radius r1 like the vertices of
+// ArgsToNgon, and the corners between them at radius r2.
+func ArgsToStar(args []float64) ([]float64, error) {
+	if len(args) < 5 {
+		return nil, NewArgError("expecting centre, two radii and number of points")
+	}
+	err := checkCorners(args[4], 4)
+	if err != nil {
+		return nil, err
+	}
+	n := int(args[4])
+	rotation := 0.0
+	if len(args) > 5 {
+		rotation = args[5]
+	}
+	outer := regularPoints(args[0], args[1], args[2], n, rotation)
+	inner := regularPoints(args[0], args[1], args[3], n, rotation+180/float64(n))
+	ret := make([]float64, 0, 4*n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, outer[2*i], outer[2*i+1], inner[2*i], inner[2*i+1])
+	}
+	return ret, nil
+}
+
+// checkCoordNum reports a number of coordinates other than that of a drawing
+// with a fixed number, or more than the most that a drawing with optional
+// arguments takes. Points make the number known only when they are looked up.
+func checkCoordNum(command int16, n int) error {
+	expect := operation.ExpectArgNum(command)
+	if !operation.NeedArgNum(command) && n != expect {
+		return NewArgError(fmt.Sprintf(
+			"expecting %d coordinates, got %d", expect, n))
+	}
+	if operation.NeedArgNum(command) && expect > 0 && n > expect {
+		return NewArgError(fmt.Sprintf(
+			"expecting at most %d coordinates, got %d", expect, n))
+	}
+	return nil
+}
+
+// lerpPoints gives the point at t of the way from the point a to b, which is
+// a for 0 and b for 1, and may be outside of them
+func lerpPoints(a, b []float64, t float64) operation.Value {
+	return operation.NewPointValue(a[0]+t*(b[0]-a[0]), a[1]+t*(b[1]-a[1]))
+}
+
+// loopSteps gives the number of times a FOR loop with the bounds and the
+// optional step, which are finite and the step not zero, runs its body
+func loopSteps(values []float64) float64 {
+	from, to, step := values[0], values[1], 1.0
+	if len(values) == 3 {
+		step = values[2]
+	}
+	if step > 0 && from > to || step < 0 && from < to {
+		return 0
+	}
+	return math.Floor((to-from)/step) + 1
+}
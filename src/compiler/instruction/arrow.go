@@ -0,0 +1,191 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import (
+	"math"
+	"compiler/operation"
+)
+
+// The width and the inset of the arrowheads, as parts of their length, which
+// are those of the arrow tips of TikZ
+const (
+	headWidth = 0.75
+	headInset = 0.325
+)
+
+/*
+Arrows gives the ends of the instruction drawn with an arrowhead, one of
+ARROW_NONE, ARROW_START, ARROW_END and ARROW_BOTH. These are the ends asked
+by the style which are open, the start of the first piece and the end of the
+last piece of a LINE, POLYLINE or PATH, unless the piece is closed or has no
+length.
+*/
+func Arrows(inst Instruction) int16 {
+	style := inst.Style.OrDefault()
+	start,end := arrowTips(inst)
+	wantStart := style.Arrow == ARROW_START || style.Arrow == ARROW_BOTH
+	wantEnd := style.Arrow == ARROW_END || style.Arrow == ARROW_BOTH
+	switch {
+	case wantStart && start != nil && wantEnd && end != nil:
+		return ARROW_BOTH
+	case wantStart && start != nil:
+		return ARROW_START
+	case wantEnd && end != nil:
+		return ARROW_END
+	}
+	return ARROW_NONE
+}
+
+/*
+ArrowHeads gives the arrowheads of the instruction as instructions, for the
+consumers of the instruction stream which do not draw arrow tips themselves,
+see also Reader.SetArrowHeads.
+They have the given length in units, and their tips are at the ends, pointing
+along the lines there. As the instruction is already transformed, so are the
+arrowheads.
+
+The head to is an open POLYLINE, while stealth and latex are POLYGON filled
+with the color of the lines. Like the instruction, they are not dashed and
+do not have arrows.
+*/
+func ArrowHeads(inst Instruction, length float64) []Instruction {
+	style := inst.Style.OrDefault()
+	arrows := Arrows(inst)
+	start,end := arrowTips(inst)
+	tips := [][]float64{}
+	if arrows == ARROW_START || arrows == ARROW_BOTH {
+		tips = append(tips,start)
+	}
+	if arrows == ARROW_END || arrows == ARROW_BOTH {
+		tips = append(tips,end)
+	}
+	headStyle := style
+	headStyle.Dash,headStyle.Arrow = DASH_SOLID,ARROW_NONE
+	command := operation.POLYLINE
+	if style.Head != HEAD_TO {
+		command = operation.POLYGON
+		headStyle.Fill = headStyle.Stroke
+	}
+	ret := []Instruction{}
+	for _,tip := range tips {
+		head,err := GetInstruction(command,headPoints(tip,style.Head,length))
+		if err != nil {
+			continue
+		}
+		head.Style = headStyle.Ref()
+		ret = append(ret,head)
+	}
+	return ret
+}
+
+// headPoints gives the points of an arrowhead at the tip, which has the point
+// of the tip and a point before it on the line
+func headPoints(tip []float64, head int16, length float64) []float64 {
+	x,y := tip[0],tip[1]
+	dx,dy := x-tip[2],y-tip[3]
+	norm := math.Hypot(dx,dy)
+	dx,dy = dx/norm*length,dy/norm*length
+	// The back corners of the head, on both sides of the line
+	bx,by := x-dx,y-dy
+	wx,wy := -dy*headWidth/2,dx*headWidth/2
+	switch head {
+	case HEAD_TO:
+		return []float64{bx+wx,by+wy,x,y,bx-wx,by-wy}
+	case HEAD_STEALTH:
+		ix,iy := bx+dx*headInset,by+dy*headInset
+		return []float64{x,y,bx+wx,by+wy,ix,iy,bx-wx,by-wy}
+	default:
+		return []float64{x,y,bx+wx,by+wy,bx-wx,by-wy}
+	}
+}
+
+// arrowTips gives the tips at the start and at the end of the instruction,
+// nil for an end which cannot have an arrowhead. A tip has the point of the
+// end, and the nearest point before it which is not the same, which for a
+// curve is a control point, as the curve is tangent to it.
+func arrowTips(inst Instruction) ([]float64,[]float64) {
+	first,last := openPieces(inst)
+	return tipOf(first,false),tipOf(last,true)
+}
+
+// tipOf gives the tip at the start or at the end of the coordinates of a
+// piece, or nil if all its points are the same
+func tipOf(coords []float64, atEnd bool) []float64 {
+	n := len(coords)/2
+	if n < 2 {
+		return nil
+	}
+	point := func(i int) (float64,float64) {
+		if atEnd {
+			i = n-1-i
+		}
+		return coords[2*i],coords[2*i+1]
+	}
+	x,y := point(0)
+	for i := 1; i < n; i++ {
+		px,py := point(i)
+		if px != x || py != y {
+			return []float64{x,y,px,py}
+		}
+	}
+	return nil
+}
+
+// openPieces gives the coordinates of the first and the last piece of a LINE,
+// POLYLINE or PATH, or nil for a piece which is closed. A piece of a PATH
+// starts at a MOVE.
+func openPieces(inst Instruction) ([]float64,[]float64) {
+	switch inst.Command {
+	case operation.LINE:
+		if len(inst.Args) != 4 {
+			return nil,nil
+		}
+		return inst.Args,inst.Args
+	case operation.POLYLINE:
+		if len(inst.Args) < 1 {
+			return nil,nil
+		}
+		return inst.Args[1:],inst.Args[1:]
+	case operation.PATH:
+		if len(inst.Args) < 1 {
+			return nil,nil
+		}
+		segments,err := PathSegments(inst.Args[1:])
+		if err != nil {
+			return nil,nil
+		}
+		pieces := [][]float64{}
+		closed := []bool{}
+		for _,segment := range segments {
+			if segment.Tag == MOVE {
+				pieces = append(pieces,[]float64{})
+				closed = append(closed,false)
+			}
+			last := len(pieces)-1
+			pieces[last] = append(pieces[last],segment.Coords...)
+			closed[last] = segment.Tag == CYCLE
+		}
+		first,last := pieces[0],pieces[len(pieces)-1]
+		if closed[0] {
+			first = nil
+		}
+		if closed[len(closed)-1] {
+			last = nil
+		}
+		return first,last
+	}
+	return nil,nil
+}
@@ -0,0 +1,107 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import "testing"
+import "math"
+import "compiler/operation"
+
+// nearlyEqual compares the coordinates of instructions up to rounding errors
+func nearlyEqual(a,b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func arrowStyle(arrow,head int16) *Style {
+	style := DefaultStyle()
+	style.Stroke,style.Dash,style.Arrow,style.Head = COLOR_RED,DASH_DASHED,
+		arrow,head
+	return &style
+}
+
+func TestArrowHeads(t *testing.T) {
+	curve := []float64{9,float64(MOVE),0,0,float64(CURVE),0,50,100,50,100,0}
+	closed := []float64{12,float64(MOVE),0,0,float64(LINE_STRIP),10,0,
+		float64(CYCLE),float64(MOVE),50,50,float64(LINE_STRIP),60,50}
+	tests := []struct {
+		inst Instruction
+		arrows int16
+		heads [][]float64
+	}{
+		{Instruction{Command: operation.LINE,Args: []float64{0,0,100,0},
+			Style: arrowStyle(ARROW_END,HEAD_LATEX)},ARROW_END,
+			[][]float64{{6,100,0,90,3.75,90,-3.75}}},
+		// Pointing up, as a line rotated by 90 degrees
+		{Instruction{Command: operation.LINE,Args: []float64{0,0,0,100},
+			Style: arrowStyle(ARROW_END,HEAD_STEALTH)},ARROW_END,
+			[][]float64{{8,0,100,-3.75,90,0,93.25,3.75,90}}},
+		// The start skips the repeated point
+		{Instruction{Command: operation.POLYLINE,
+			Args: []float64{6,0,0,0,0,0,10},
+			Style: arrowStyle(ARROW_BOTH,HEAD_TO)},ARROW_BOTH,
+			[][]float64{{6,3.75,10,0,0,-3.75,10},{6,-3.75,0,0,10,3.75,0}}},
+		// Along the control point of the curve at the end
+		{Instruction{Command: operation.PATH,Args: curve,
+			Style: arrowStyle(ARROW_END,HEAD_LATEX)},ARROW_END,
+			[][]float64{{6,100,0,103.75,10,96.25,10}}},
+		// The first piece is closed
+		{Instruction{Command: operation.PATH,Args: closed,
+			Style: arrowStyle(ARROW_BOTH,HEAD_LATEX)},ARROW_END,
+			[][]float64{{6,60,50,50,53.75,50,46.25}}},
+		{Instruction{Command: operation.PATH,Args: closed,
+			Style: arrowStyle(ARROW_START,HEAD_LATEX)},ARROW_NONE,nil},
+		{Instruction{Command: operation.LINE,Args: []float64{5,5,5,5},
+			Style: arrowStyle(ARROW_BOTH,HEAD_LATEX)},ARROW_NONE,nil},
+		{Instruction{Command: operation.POLYGON,Args: []float64{6,0,0,10,0,0,10},
+			Style: arrowStyle(ARROW_BOTH,HEAD_LATEX)},ARROW_NONE,nil},
+		{Instruction{Command: operation.LINE,Args: []float64{0,0,100,0}},
+			ARROW_NONE,nil},
+	}
+	for _,test := range tests {
+		if arrows := Arrows(test.inst); arrows != test.arrows {
+			t.Errorf("Expect arrows %d for %s, got %d",test.arrows,
+				test.inst.ToString(),arrows)
+		}
+		heads := ArrowHeads(test.inst,10)
+		if len(heads) != len(test.heads) {
+			t.Errorf("Expect %d arrowheads for %s, got %d",len(test.heads),
+				test.inst.ToString(),len(heads))
+			continue
+		}
+		for i,head := range heads {
+			if !nearlyEqual(head.Args,test.heads[i]) {
+				t.Errorf("Expect arrowhead %v for %s, got %v",test.heads[i],
+					test.inst.ToString(),head.Args)
+			}
+			style := head.Style.OrDefault()
+			if style.Arrow != ARROW_NONE || style.Dash != DASH_SOLID ||
+				style.Stroke != COLOR_RED {
+				t.Errorf("Wrong style of arrowhead %s",head.ToString())
+			}
+			filled := test.inst.Style.Head != HEAD_TO
+			if filled != (head.Command == operation.POLYGON) ||
+				filled != (style.Fill == COLOR_RED) {
+				t.Errorf("Wrong arrowhead %s",head.ToString())
+			}
+		}
+	}
+}
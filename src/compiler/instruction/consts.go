@@ -14,8 +14,130 @@
 // along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
 package instruction
 
+// Segments of a PATH, each tag followed by its points. MOVE starts a new
+// piece at its point, LINE_STRIP draws a line to its point, CURVE a cubic
+// Bézier curve with two control points and the end point, and CYCLE a line
+// back to the start of the piece.
 const (
 	LINE_STRIP int16 = iota
 	CURVE
 	CYCLE
+	MOVE
 )
+
+// segmentSizes gives the number of coordinates after each tag of a segment
+var segmentSizes = []int{2,6,0,2}
+
+// Encodings of the coordinates in the byte string. The command of each
+// instruction is always a 16-bit word.
+const (
+	WORD16 int16 = iota
+	WORD32
+)
+
+// Anchors of a text, i.e. the point of the text put at the position of the
+// instruction
+const (
+	ANCHOR_CENTER int16 = iota
+	ANCHOR_NORTH
+	ANCHOR_SOUTH
+	ANCHOR_EAST
+	ANCHOR_WEST
+	ANCHOR_NORTH_EAST
+	ANCHOR_NORTH_WEST
+	ANCHOR_SOUTH_EAST
+	ANCHOR_SOUTH_WEST
+	ANCHOR_BASE
+)
+
+// Alignments of the lines of a text
+const (
+	ALIGN_CENTER int16 = iota
+	ALIGN_LEFT
+	ALIGN_RIGHT
+)
+
+var anchorNames = []string{
+	"center","north","south","east","west",
+	"northeast","northwest","southeast","southwest","base",
+}
+
+var alignNames = []string{"center","left","right"}
+
+// Colors of the lines and the inside of shapes, with the names they have in
+// LaTeX's xcolor. COLOR_NONE leaves the lines or the inside undrawn.
+const (
+	COLOR_NONE int16 = iota
+	COLOR_BLACK
+	COLOR_WHITE
+	COLOR_RED
+	COLOR_GREEN
+	COLOR_BLUE
+	COLOR_CYAN
+	COLOR_MAGENTA
+	COLOR_YELLOW
+	COLOR_GRAY
+	COLOR_DARKGRAY
+	COLOR_LIGHTGRAY
+	COLOR_BROWN
+	COLOR_LIME
+	COLOR_OLIVE
+	COLOR_ORANGE
+	COLOR_PINK
+	COLOR_PURPLE
+	COLOR_TEAL
+	COLOR_VIOLET
+)
+
+// Dash patterns of the lines
+const (
+	DASH_SOLID int16 = iota
+	DASH_DASHED
+	DASH_DOTTED
+	DASH_DASHDOT
+)
+
+// Shapes of the ends of the lines
+const (
+	CAP_BUTT int16 = iota
+	CAP_ROUND
+	CAP_RECT
+)
+
+// Shapes of the corners where lines meet
+const (
+	JOIN_MITER int16 = iota
+	JOIN_ROUND
+	JOIN_BEVEL
+)
+
+// Ends of an open line that have an arrowhead
+const (
+	ARROW_NONE int16 = iota
+	ARROW_START
+	ARROW_END
+	ARROW_BOTH
+)
+
+// Shapes of the arrowheads, as the arrow tips of TikZ
+const (
+	HEAD_TO int16 = iota
+	HEAD_STEALTH
+	HEAD_LATEX
+)
+
+var colorNames = []string{
+	"none","black","white","red","green","blue","cyan","magenta","yellow",
+	"gray","darkgray","lightgray","brown","lime","olive","orange","pink",
+	"purple","teal","violet",
+}
+
+var dashNames = []string{"solid","dashed","dotted","dashdot"}
+
+var capNames = []string{"butt","round","rect"}
+
+var joinNames = []string{"miter","round","bevel"}
+
+var arrowNames = []string{"none","start","end","both"}
+
+var headNames = []string{"to","stealth","latex"}
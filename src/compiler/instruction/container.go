@@ -0,0 +1,223 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"hash/crc32"
+	"math"
+	"sort"
+	"compiler/operation"
+)
+
+// Magic starts every .anm file with a header. Files written before the header
+// was introduced start directly with an instruction, whose first byte is 0.
+var Magic = []byte{0x89,'A','N','M'}
+
+// FormatVersion is the version of the container written by EncodeFile.
+// DecodeFile reads it, the older versions from MinFormatVersion and headerless
+// files. Version 2 added the arrow and the head to STYLE records, see Style.
+const FormatVersion uint16 = 2
+
+// MinFormatVersion is the oldest version of the container DecodeFile reads
+const MinFormatVersion uint16 = 1
+
+// MaxMetadata is the largest number of metadata entries, and of bytes of a
+// key or a value, as they are written as uint16
+const MaxMetadata = math.MaxUint16
+
+// DefaultUnit is the size of a coordinate unit in millimetres, the one atikz
+// has always assumed
+const DefaultUnit float64 = 0.1
+
+/*
+Header describes the drawing in a .anm file. The file is laid out as follows,
+with all numbers big-endian.
+
+	magic          4 bytes, see Magic
+	version        uint16
+	encoding       int16, WORD16 or WORD32
+	unit           float64, size of a coordinate unit in millimetres
+	bounding box   4 float64, MinX MinY MaxX MaxY
+	metadata       uint16 count, then each key and value as uint16 length
+	               followed by UTF-8 bytes, with keys in sorted order
+	count          uint32, number of instructions, not counting STYLE records
+	instructions   as written by EncodeInstructions with the encoding
+	checksum       uint32, CRC-32 (IEEE) of all the bytes before it
+
+A file without the magic number is a headerless file of the compiler before
+the container, see DecodeFile.
+*/
+type Header struct {
+	Version  uint16
+	Encoding int16
+	Unit     float64
+	MinX,MinY,MaxX,MaxY float64
+	Metadata map[string]string
+	Count    int
+}
+
+func NewHeader(encoding int16) *Header {
+	return &Header{FormatVersion,encoding,DefaultUnit,
+		0,0,0,0,map[string]string{},0}
+}
+
+// BoundingBox computes the smallest box containing all the instructions. An
+// oval with centre C and semi-diameters U, V extends |(Ux,Vx)| from Cx and
+// |(Uy,Vy)| from Cy. It is all zero if there is no instruction.
+func BoundingBox(insts []Instruction) (minx,miny,maxx,maxy float64) {
+	first := true
+	extend := func(x0,y0,x1,y1 float64) {
+		if first || x0 < minx {
+			minx = x0
+		}
+		if first || y0 < miny {
+			miny = y0
+		}
+		if first || x1 > maxx {
+			maxx = x1
+		}
+		if first || y1 > maxy {
+			maxy = y1
+		}
+		first = false
+	}
+	for _,inst := range insts {
+		args := inst.Args
+		switch inst.Command {
+		case operation.OVAL:
+			rx := math.Hypot(args[2],args[4])
+			ry := math.Hypot(args[3],args[5])
+			extend(args[0]-rx,args[1]-ry,args[0]+rx,args[1]+ry)
+			continue
+		case operation.POLYGON,operation.POLYLINE:
+			args = args[1:]
+		case operation.PATH:
+			// The curves are inside the hull of their control points
+			args = []float64{}
+			segments,_ := PathSegments(inst.Args[1:])
+			for _,segment := range segments {
+				args = append(args,segment.Coords...)
+			}
+		case operation.TEXT:
+			// Only the position, the size of the text is not known here
+			args = args[:2]
+		}
+		for i := 0; i+1 < len(args); i += 2 {
+			extend(args[i],args[i+1],args[i],args[i+1])
+		}
+	}
+	return
+}
+
+// EncodeFile writes the instructions with the header in the container. The
+// version, bounding box and count of the header are filled in here, the
+// other fields are taken as given. Metadata beyond MaxMetadata is an error.
+func EncodeFile(header *Header,insts []Instruction) ([]byte,error) {
+	if len(header.Metadata) > MaxMetadata {
+		return nil,NewInstructionError(fmt.Sprintf(
+			"%d metadata entries exceed the limit %d",
+			len(header.Metadata),MaxMetadata))
+	}
+	for key,value := range header.Metadata {
+		if len(key) > MaxMetadata || len(value) > MaxMetadata {
+			return nil,NewInstructionError(fmt.Sprintf(
+				"metadata %.20q exceeds the limit of %d bytes",key,MaxMetadata))
+		}
+	}
+	header.Version = FormatVersion
+	header.Count = len(insts)
+	header.MinX,header.MinY,header.MaxX,header.MaxY = BoundingBox(insts)
+
+	ret := append([]byte{},Magic...)
+	ret = binary.BigEndian.AppendUint16(ret,header.Version)
+	ret = binary.BigEndian.AppendUint16(ret,uint16(header.Encoding))
+	for _,v := range []float64{header.Unit,
+		header.MinX,header.MinY,header.MaxX,header.MaxY} {
+		ret = binary.BigEndian.AppendUint64(ret,math.Float64bits(v))
+	}
+	keys := make([]string,0,len(header.Metadata))
+	for key := range header.Metadata {
+		keys = append(keys,key)
+	}
+	sort.Strings(keys)
+	ret = binary.BigEndian.AppendUint16(ret,uint16(len(keys)))
+	for _,key := range keys {
+		for _,str := range []string{key,header.Metadata[key]} {
+			ret = binary.BigEndian.AppendUint16(ret,uint16(len(str)))
+			ret = append(ret,str...)
+		}
+	}
+	ret = binary.BigEndian.AppendUint32(ret,uint32(header.Count))
+	ret = append(ret,EncodeInstructions(insts,header.Encoding)...)
+	return binary.BigEndian.AppendUint32(ret,crc32.ChecksumIEEE(ret)),nil
+}
+
+// IsLegacy tells whether the data is a plain instruction stream without the
+// header
+func IsLegacy(data []byte) bool {
+	for i := range Magic {
+		if i >= len(data) || data[i] != Magic[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeFile reads the header and the instructions of a .anm file with a
+// Reader. A legacy file without a header is read as the instructions written
+// before the container, whose ovals have 16 words, with the given encoding.
+// Then the header has version 0 and is filled in from the instructions.
+func DecodeFile(data []byte,legacyEncoding int16) (*Header,[]Instruction,error) {
+	r,err := NewReader(bytes.NewReader(data),legacyEncoding)
+	if err != nil {
+		return nil,nil,err
+	}
+	insts := []Instruction{}
+	for {
+		inst,err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A damaged file is reported as such, rather than by whatever
+			// the damage looks like
+			damaged := IsDecodeError(err,INVALID_COMMAND) ||
+				IsDecodeError(err,INVALID_LENGTH)
+			if !r.IsLegacy() && damaged && !hasChecksum(data) {
+				return nil,insts,NewDecodeError(BAD_CHECKSUM,len(data)-4,
+					"corrupted file: checksum mismatch")
+			}
+			return nil,insts,err
+		}
+		insts = append(insts,inst)
+	}
+	header := r.Header()
+	if r.IsLegacy() {
+		header.Count = len(insts)
+		header.MinX,header.MinY,header.MaxX,header.MaxY = BoundingBox(insts)
+	}
+	return header,insts,nil
+}
+
+// hasChecksum tells whether the data ends with the checksum of the rest
+func hasChecksum(data []byte) bool {
+	body := len(data)-4
+	return body >= 0 && crc32.ChecksumIEEE(data[:body]) ==
+		binary.BigEndian.Uint32(data[body:])
+}
@@ -0,0 +1,242 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import "testing"
+import "strings"
+import "strconv"
+import "reflect"
+import "encoding/binary"
+import "hash/crc32"
+import "compiler/operation"
+
+var testStyle = &Style{COLOR_RED,COLOR_BLUE,1.5,DASH_DASHED,0.25,
+	CAP_ROUND,JOIN_BEVEL,ARROW_END,HEAD_STEALTH}
+
+// The text and the line share a style, which is written once
+var containerTests = []Instruction {
+	{Command: operation.TEXT,Args: []float64{50,60,
+		float64(ANCHOR_SOUTH_WEST),float64(ALIGN_LEFT)},Text: `$\alpha$ \\ "b"`,
+		Style: testStyle},
+	{Command: operation.LINE,Args: []float64{120,300,110,310},Style: testStyle},
+	{Command: operation.PATH,Args: []float64{14,float64(MOVE),0,0,
+		float64(LINE_STRIP),100,0,float64(CURVE),150,50,150,100,100,150,
+		float64(CYCLE)}},
+	{Command: operation.POLYGON,Args: []float64{6,110,100,0,-10,210,220}},
+	{Command: operation.OVAL,Args: []float64{0,0,30,40,-40,30}},
+}
+
+// encodeFile is EncodeFile for instructions and metadata known to be valid
+func encodeFile(tb testing.TB, header *Header, insts []Instruction) []byte {
+	data,err := EncodeFile(header,insts)
+	if err != nil {
+		tb.Fatalf("Error in EncodeFile: %s",err.Error())
+	}
+	return data
+}
+
+func TestEncodeFile(t *testing.T) {
+	for _,encoding := range []int16{WORD16,WORD32} {
+		header := NewHeader(encoding)
+		header.Metadata["source"] = "lines.adr"
+		header.Metadata["title"] = "Lines"
+		data := encodeFile(t,header,containerTests)
+		result,insts,err := DecodeFile(data,WORD16)
+		if err != nil {
+			t.Fatalf("Error in DecodeFile: %s",err.Error())
+		}
+		if !reflect.DeepEqual(insts,containerTests) {
+			t.Errorf("Wrong instructions decoded: %v",insts)
+		}
+		if !reflect.DeepEqual(result,header) {
+			t.Errorf("Wrong header decoded: expect %v, got %v",header,result)
+		}
+		// The oval reaches 50 from its centre horizontally
+		if result.MinX != -50 || result.MinY != -50 ||
+			result.MaxX != 210 || result.MaxY != 310 || result.Count != 5 {
+			t.Errorf("Wrong bounding box or count in header: %v",result)
+		}
+	}
+}
+
+// Metadata is written with uint16 sizes, anything longer is refused rather
+// than cut
+func TestEncodeFileMetadataLimit(t *testing.T) {
+	long := strings.Repeat("a",MaxMetadata)
+	header := NewHeader(WORD16)
+	header.Metadata[long] = long
+	_,insts,err := DecodeFile(encodeFile(t,header,containerTests),WORD16)
+	if err != nil || len(insts) != len(containerTests) {
+		t.Errorf("Expect metadata at the limit to be read back, got %v",err)
+	}
+	tooLong := NewHeader(WORD16)
+	tooLong.Metadata["title"] = long+"a"
+	tooMany := NewHeader(WORD16)
+	for i := 0; i <= MaxMetadata; i++ {
+		tooMany.Metadata[strconv.Itoa(i)] = ""
+	}
+	for _,header := range []*Header{tooLong,tooMany} {
+		if _,err := EncodeFile(header,containerTests); err == nil ||
+			!strings.Contains(err.Error(),"exceed") {
+			t.Errorf("Expect error for metadata over the limit, got %v",err)
+		}
+	}
+}
+
+// legacyBytes gives the words of a headerless file as written before
+func legacyBytes(words []int16) []byte {
+	ret := []byte{}
+	for _,word := range words {
+		ret = binary.BigEndian.AppendUint16(ret,uint16(word))
+	}
+	return ret
+}
+
+// The file written by the compiler before the container for
+//
+//	line 0 0 100 50
+//	rect 10 20 30 40
+//	oval 100 100 50 30
+//	polygon 0 0 10 0 10 10
+//	rotate R 30
+//	push R
+//	oval 100 100 50 30
+//
+// where the ovals have 16 words and the coordinates are truncated
+var legacyFile = legacyBytes([]int16{
+	1,0,0,100,50,
+	2,10,20,10,40,30,40,30,20,
+	3,150,100,150,130,100,130,50,130,50,100,50,70,100,70,150,70,
+	4,6,0,0,10,0,10,10,
+	3,79,161,64,187,21,162,-21,137,-6,111,8,85,51,110,94,135,
+})
+
+// The instructions of legacyFile, with the ovals as centre and semi-diameters
+var legacyInsts = []Instruction{
+	{Command: operation.LINE,Args: []float64{0,0,100,50}},
+	{Command: operation.RECT,Args: []float64{10,20,10,40,30,40,30,20}},
+	{Command: operation.OVAL,Args: []float64{100,100,50,0,0,30}},
+	{Command: operation.POLYGON,Args: []float64{6,0,0,10,0,10,10}},
+	{Command: operation.OVAL,Args: []float64{36.5,136,42.5,25,-15,26}},
+}
+
+func TestDecodeLegacyFile(t *testing.T) {
+	header,insts,err := DecodeFile(legacyFile,WORD16)
+	if err != nil {
+		t.Fatalf("Error in DecodeFile: %s",err.Error())
+	}
+	if header.Version != 0 || header.Count != 5 ||
+		!reflect.DeepEqual(insts,legacyInsts) {
+		t.Errorf("Wrong legacy file decoded: %v %v",header,insts)
+	}
+	header,insts,err = DecodeFile([]byte{},WORD16)
+	if err != nil || header.Count != 0 || len(insts) != 0 {
+		t.Errorf("Expect empty legacy file, got %v %v %v",header,insts,err)
+	}
+}
+
+func withChecksum(data []byte) []byte {
+	return binary.BigEndian.AppendUint32(data,crc32.ChecksumIEEE(data))
+}
+
+// A file of version 1 has STYLE records of seven words, without the arrow and
+// the head
+func TestDecodeVersion1(t *testing.T) {
+	for _,encoding := range []int16{WORD16,WORD32} {
+		data := encodeFile(t,NewHeader(encoding),containerTests)
+		body := len(data)-4-len(EncodeInstructions(containerTests,encoding))
+		old := append([]byte{},data[:body]...)
+		binary.BigEndian.PutUint16(old[len(Magic):],1)
+		var last *Style
+		for _,inst := range containerTests {
+			if !sameStyle(inst.Style,last) {
+				record := Instruction{Command: operation.STYLE,
+					Args: inst.Style.OrDefault().words()[:styleWordsV1]}
+				old = append(old,record.Encode(encoding)...)
+				last = inst.Style
+			}
+			old = append(old,inst.Encode(encoding)...)
+		}
+		header,insts,err := DecodeFile(withChecksum(old),WORD16)
+		if err != nil {
+			t.Fatalf("Error in DecodeFile: %s",err.Error())
+		}
+		style := *testStyle
+		style.Arrow,style.Head = ARROW_NONE,HEAD_TO
+		if header.Version != 1 || len(insts) != len(containerTests) ||
+			*insts[1].Style != style || insts[2].Style != nil ||
+			!reflect.DeepEqual(insts[4].Args,containerTests[4].Args) {
+			t.Errorf("Wrong version 1 file decoded: %v %v",header,insts)
+		}
+	}
+}
+
+func TestDecodeFileErrors(t *testing.T) {
+	data := encodeFile(t,NewHeader(WORD16),containerTests)
+	// Every proper prefix past the magic number is truncated
+	for size := len(Magic); size < len(data); size++ {
+		_,_,err := DecodeFile(data[:size],WORD16)
+		if err == nil || !strings.Contains(err.Error(),"truncated") &&
+			!strings.Contains(err.Error(),"checksum") {
+			t.Errorf("Expect truncation for %d of %d bytes, got %v",
+				size,len(data),err)
+		}
+	}
+	// Any single corrupted byte is noticed
+	for i := len(Magic); i < len(data); i++ {
+		corrupted := append([]byte{},data...)
+		corrupted[i] ^= 0x10
+		if _,_,err := DecodeFile(corrupted,WORD16); err == nil {
+			t.Errorf("Expect error for corrupted byte %d",i)
+		}
+	}
+	tests := map[string][]byte{
+		"unsupported format version 3": append(append([]byte{},Magic...),0,3),
+		"unsupported format version 0": append(append([]byte{},Magic...),0,0),
+		"checksum mismatch": withChecksum(append(
+			data[:len(data)-4:len(data)-4],0,0)),
+		"unexpected bytes": append(data[:len(data):len(data)],0,0),
+	}
+	for expect,test := range tests {
+		_,_,err := DecodeFile(test,WORD16)
+		if err == nil || !strings.Contains(err.Error(),expect) {
+			t.Errorf("Expect error containing %s, got %v",expect,err)
+		}
+	}
+}
+
+// FuzzDecodeFile checks that the decoder of the container never panics, and
+// fails only with a DecodeError inside the data
+func FuzzDecodeFile(f *testing.F) {
+	header := NewHeader(WORD32)
+	header.Metadata["title"] = "Lines"
+	f.Add(encodeFile(f,NewHeader(WORD16),containerTests))
+	f.Add(encodeFile(f,header,containerTests))
+	f.Add(append(append([]byte{},Magic...),0,1,0,1))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header,insts,err := DecodeFile(data,WORD16)
+		if err != nil {
+			e,ok := err.(*DecodeError)
+			if !ok || e.Offset < 0 || e.Offset > len(data) {
+				t.Fatalf("Unexpected error %v",err)
+			}
+			return
+		}
+		if header.Count != len(insts) {
+			t.Fatalf("Header counts %d instructions, got %d",
+				header.Count,len(insts))
+		}
+	})
+}
@@ -14,6 +14,7 @@
 // along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
 package instruction
 
+import "fmt"
 
 type InstructionError struct {
 	reason string
@@ -27,3 +28,38 @@ func NewInstructionError(reason string) *InstructionError {
 func (e *InstructionError) Error() string {
 	return e.reason
 }
+
+// Kinds of DecodeError
+const (
+	TRUNCATED int16 = iota
+	INVALID_COMMAND
+	INVALID_LENGTH
+	UNSUPPORTED_VERSION
+	UNKNOWN_ENCODING
+	INVALID_UNIT
+	BAD_CHECKSUM
+	TRAILING_DATA
+	INVALID_ARGUMENT
+)
+
+// DecodeError reports malformed data met while decoding instructions, with
+// the offset in bytes where the offending part starts.
+type DecodeError struct {
+	Kind   int16
+	Offset int
+	reason string
+}
+
+func NewDecodeError(kind int16, offset int, reason string) *DecodeError {
+	return &DecodeError{kind,offset,reason}
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("byte %d: %s",e.Offset,e.reason)
+}
+
+// IsDecodeError tells whether the error is a DecodeError of the kind
+func IsDecodeError(err error, kind int16) bool {
+	e,ok := err.(*DecodeError)
+	return ok && e.Kind == kind
+}
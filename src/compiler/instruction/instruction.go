@@ -16,18 +16,24 @@ package instruction
 
 import (
   "fmt"
+  "math"
   "strconv"
   "reflect"
   "compiler/operation"
 )
 
+// Instruction is a shape to draw, with its coordinates in Args. A TEXT has
+// the string in Text, and its Args are the position, the anchor and the
+// alignment. Style is nil for the default style.
 type Instruction struct {
 	Command int16
-	Args []int16
+	Args []float64
+	Text string
+	Style *Style
 }
 
 func NewInstruction() Instruction {
-	return Instruction{0,[]int16{}}
+	return Instruction{0,[]float64{},"",nil}
 }
 
 func (inst *Instruction) Equal(inst2 Instruction) bool {
@@ -35,21 +41,68 @@ func (inst *Instruction) Equal(inst2 Instruction) bool {
 }
 
 func (inst *Instruction) ToString() string {
-	return fmt.Sprintf("%s %d",operation.GetName(inst.Command),inst.Args)
+	ret := fmt.Sprintf("%s %g",operation.GetName(inst.Command),inst.Args)
+	if inst.Command == operation.TEXT {
+		ret += " "+operation.Quote(inst.Text)
+	}
+	if inst.Style != nil {
+		ret += " ["+inst.Style.ToString()+"]"
+	}
+	return ret
 }
 
+// Instruction.ToBytes encodes the instruction as big-endian int16 words, so
+// the coordinates are rounded to the nearest integer.
 func (inst *Instruction) ToBytes() []byte {
-	ret := make([]byte,len(inst.Args)*2+2)
+	return inst.Encode(WORD16)
+}
+
+// Instruction.Encode encodes the command as a big-endian int16 word, followed
+// by the coordinates rounded to the nearest integer, as words of the given
+// encoding. Coordinates out of range are not checked here, see CheckRange.
+// The text of a TEXT comes last, as its length in a uint16 and the bytes.
+// The style is not included, see EncodeInstructions.
+func (inst *Instruction) Encode(encoding int16) []byte {
+	size := wordSize(encoding)
+	ret := make([]byte,len(inst.Args)*size+2)
 	ret[0] = byte(inst.Command/256)
 	ret[1] = byte(inst.Command%256)
 	for i := 0; i < len(inst.Args); i++ {
-		ret[2*i+2] = byte(uint(inst.Args[i])/256)
-		ret[2*i+3] = byte(uint(inst.Args[i])%256)
+		word := uint32(int32(math.Round(inst.Args[i])))
+		for j := 0; j < size; j++ {
+			ret[2+i*size+j] = byte(word >> uint(8*(size-1-j)))
+		}
+	}
+	if inst.Command == operation.TEXT {
+		ret = append(ret,byte(len(inst.Text)>>8),byte(len(inst.Text)))
+		ret = append(ret,inst.Text...)
 	}
 	return ret
 }
 
-func GetInstruction(command int16, args []int16) (Instruction,error) {
+// CoordRange gives the smallest and the largest coordinate that can be stored
+// in the encoding.
+func CoordRange(encoding int16) (float64,float64) {
+	if encoding == WORD32 {
+		return math.MinInt32,math.MaxInt32
+	}
+	return math.MinInt16,math.MaxInt16
+}
+
+// Instruction.CheckRange reports the first coordinate which would not fit in
+// the encoding after rounding, instead of letting it wrap around.
+func (inst *Instruction) CheckRange(encoding int16) error {
+	min,max := CoordRange(encoding)
+	for _,v := range inst.Args {
+		if r := math.Round(v); !(r >= min && r <= max) {
+			return NewInstructionError(fmt.Sprintf(
+				"coordinate %g out of range [%g,%g]",v,min,max))
+		}
+	}
+	return nil
+}
+
+func GetInstruction(command int16, args []float64) (Instruction,error) {
 	inst := NewInstruction()
 	inst.Command = command
 	switch command {
@@ -67,10 +120,19 @@ func GetInstruction(command int16, args []int16) (Instruction,error) {
 		inst.Args = args
 		return inst,nil
 	case operation.POLYGON:
+		fallthrough
+	case operation.POLYLINE:
 		if len(args) < 4 || len(args)%2 == 1 {
 			return NewInstruction(),NewInstructionError(
 				"invalid number of arguments: got "+
-				strconv.Itoa(len(args))+" for polygon")
+				strconv.Itoa(len(args))+" for "+operation.GetName(command))
+		}
+		inst.Args = addLengthPrefix(args)
+		return inst,nil
+	case operation.PATH:
+		_,err := PathSegments(args)
+		if err != nil {
+			return NewInstruction(),err
 		}
 		inst.Args = addLengthPrefix(args)
 		return inst,nil
@@ -79,3 +141,84 @@ func GetInstruction(command int16, args []int16) (Instruction,error) {
 			"invalid draw command: "+operation.GetName(command))
 	}
 }
+
+// Segment is a piece of a PATH, with the tag and the coordinates of the points
+type Segment struct {
+	Tag int16
+	Coords []float64
+}
+
+// PathSegments splits the arguments of a PATH, without the length in front,
+// into segments. It reports arguments not made of whole segments, or not
+// starting with MOVE.
+func PathSegments(args []float64) ([]Segment,error) {
+	ret := []Segment{}
+	for i := 0; i < len(args); {
+		tag := code(args[i])
+		if tag < 0 || int(tag) >= len(segmentSizes) || float64(tag) != args[i] {
+			return ret,NewInstructionError(fmt.Sprintf(
+				"invalid segment %g of path",args[i]))
+		}
+		if i == 0 && tag != MOVE {
+			return ret,NewInstructionError("path does not start with a move")
+		}
+		size := segmentSizes[tag]
+		if i+1+size > len(args) {
+			return ret,NewInstructionError(fmt.Sprintf(
+				"incomplete segment at argument %d of path",i))
+		}
+		ret = append(ret,Segment{tag,args[i+1:i+1+size]})
+		i += 1+size
+	}
+	if len(ret) == 0 {
+		return ret,NewInstructionError("empty path")
+	}
+	return ret,nil
+}
+
+// NewPathInstruction makes a PATH of the segments, whose coordinates are
+// taken from coords in order
+func NewPathInstruction(tags []int16, coords []float64) (Instruction,error) {
+	args := []float64{}
+	for _,tag := range tags {
+		if tag < 0 || int(tag) >= len(segmentSizes) ||
+			len(coords) < segmentSizes[tag] {
+			return NewInstruction(),NewInstructionError(
+				"invalid segments of path")
+		}
+		args = append(args,float64(tag))
+		args = append(args,coords[:segmentSizes[tag]]...)
+		coords = coords[segmentSizes[tag]:]
+	}
+	return GetInstruction(operation.PATH,args)
+}
+
+// GetAnchor gives the anchor of a text by its name, like north or southwest
+func GetAnchor(name string) (int16,bool) {
+	return lookupName(anchorNames,name)
+}
+
+// GetAlign gives the alignment of a text by its name, left, right or center
+func GetAlign(name string) (int16,bool) {
+	return lookupName(alignNames,name)
+}
+
+// NewTextInstruction makes a TEXT at the position, after checking the anchor,
+// the alignment and the length of the text
+func NewTextInstruction(x,y float64, anchor,align int16,
+	text string) (Instruction,error) {
+	if anchor < 0 || int(anchor) >= len(anchorNames) {
+		return NewInstruction(),NewInstructionError(
+			"invalid anchor "+strconv.Itoa(int(anchor)))
+	}
+	if align < 0 || int(align) >= len(alignNames) {
+		return NewInstruction(),NewInstructionError(
+			"invalid alignment "+strconv.Itoa(int(align)))
+	}
+	if len(text) > MaxTextLength {
+		return NewInstruction(),NewInstructionError(fmt.Sprintf(
+			"text of %d bytes exceeds the limit %d",len(text),MaxTextLength))
+	}
+	return Instruction{operation.TEXT,
+		[]float64{x,y,float64(anchor),float64(align)},text,nil},nil
+}
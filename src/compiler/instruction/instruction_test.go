@@ -15,6 +15,9 @@
 package instruction
 
 import "testing"
+import "math"
+import "reflect"
+import "strings"
 import "compiler/operation"
 
 func TestGetInstruction(t *testing.T) {
@@ -27,16 +30,18 @@ func TestGetInstruction(t *testing.T) {
 		"oval 110 110 100 50",
 		"rect 110 0 0 110",
 		"line 120 300 110 310",
+		"polyline 0 0 10 10 20 0 30 10",
 	}
 	results := []Instruction {
-		{operation.LINE,[]int16{120,300,110,310}},
-		{operation.RECT,[]int16{110,0,110,110,0,110,0,0}},
-		{operation.POLYGON,[]int16{6,110,100,0,10,210,220}},
-		{operation.OVAL,[]int16{210,110,210,160,110,160,10,160,10,110,10,60,110,60,210,60}},
-		{operation.POLYGON,[]int16{6,110,100,0,10,210,220}},
-		{operation.OVAL,[]int16{210,110,210,160,110,160,10,160,10,110,10,60,110,60,210,60}},
-		{operation.RECT,[]int16{110,0,110,110,0,110,0,0}},
-		{operation.LINE,[]int16{120,300,110,310}},
+		{Command: operation.LINE,Args: []float64{120,300,110,310}},
+		{Command: operation.RECT,Args: []float64{110,0,110,110,0,110,0,0}},
+		{Command: operation.POLYGON,Args: []float64{6,110,100,0,10,210,220}},
+		{Command: operation.OVAL,Args: []float64{110,110,100,0,0,50}},
+		{Command: operation.POLYGON,Args: []float64{6,110,100,0,10,210,220}},
+		{Command: operation.OVAL,Args: []float64{110,110,100,0,0,50}},
+		{Command: operation.RECT,Args: []float64{110,0,110,110,0,110,0,0}},
+		{Command: operation.LINE,Args: []float64{120,300,110,310}},
+		{Command: operation.POLYLINE,Args: []float64{8,0,0,10,10,20,0,30,10}},
 	}
 	for i := 0; i < len(tests); i++ {
 		parser := operation.NewLineParser()
@@ -44,7 +49,7 @@ func TestGetInstruction(t *testing.T) {
 		if err != nil {
 			t.Errorf("Failed to parse: %s",tests[i])
 		}
-		args,ok := operation.ValuesToInt(oper.Args)
+		args,ok := operation.ValuesToFloat(oper.Args)
 		if !ok {
 			t.Errorf("Failed to evaluate arguments: %s",oper.ToString())
 		}
@@ -68,14 +73,14 @@ func TestGetInstruction(t *testing.T) {
 
 func TestBytesToInstructions(t *testing.T) {
 	tests := []Instruction {
-		{operation.LINE,[]int16{120,300,110,310}},
-		{operation.RECT,[]int16{110,0,110,110,0,110,0,0}},
-		{operation.POLYGON,[]int16{6,110,100,0,10,210,220}},
-		{operation.OVAL,[]int16{210,110,210,160,110,160,10,160,10,110,10,60,110,60,210,60}},
-		{operation.POLYGON,[]int16{6,110,100,0,10,210,220}},
-		{operation.OVAL,[]int16{210,110,210,160,110,160,10,160,10,110,10,60,110,60,210,60}},
-		{operation.RECT,[]int16{110,0,110,110,0,110,0,0}},
-		{operation.LINE,[]int16{120,300,110,310}},
+		{Command: operation.LINE,Args: []float64{120,300,110,310}},
+		{Command: operation.RECT,Args: []float64{110,0,110,110,0,110,0,0}},
+		{Command: operation.POLYGON,Args: []float64{6,110,100,0,10,210,220}},
+		{Command: operation.OVAL,Args: []float64{110,110,100,0,0,50}},
+		{Command: operation.POLYGON,Args: []float64{6,110,100,0,10,210,220}},
+		{Command: operation.OVAL,Args: []float64{110,110,100,0,0,50}},
+		{Command: operation.RECT,Args: []float64{110,0,110,110,0,110,0,0}},
+		{Command: operation.LINE,Args: []float64{120,300,110,310}},
 	}
 	bytes := InstructionsToBytes(tests)
 	results,err := BytesToInstructions(bytes)
@@ -92,3 +97,140 @@ func TestBytesToInstructions(t *testing.T) {
 		}
 	}
 }
+
+func TestToBytesRounding(t *testing.T) {
+	inst := Instruction{Command: operation.LINE,Args: []float64{1.4,1.6,-1.5,-2.6}}
+	expect := Instruction{Command: operation.LINE,Args: []float64{1,2,-2,-3}}
+	results,err := BytesToInstructions(inst.ToBytes())
+	if err != nil {
+		t.Fatalf("Error in BytesToInstructions: %s",err.Error())
+	}
+	if len(results) != 1 || !results[0].Equal(expect) {
+		t.Errorf("Expect coordinates rounded to %s, got %v",
+			expect.ToString(),results)
+	}
+}
+
+func TestEncodeInstructionsWide(t *testing.T) {
+	tests := []Instruction {
+		{Command: operation.LINE,Args: []float64{120000,-300000,32768,-32769}},
+		{Command: operation.POLYGON,Args: []float64{6,110,100,0,-100000,2100000,220}},
+		{Command: operation.OVAL,Args: []float64{-1,70000,100,0,0,50}},
+	}
+	bytes := EncodeInstructions(tests,WORD32)
+	results,err := DecodeInstructions(bytes,WORD32)
+	if err != nil {
+		t.Fatalf("Error in DecodeInstructions: %s",err.Error())
+	}
+	if len(tests) != len(results) {
+		t.Fatalf("Got wrong number of results: %d vs %d",len(results),len(tests))
+	}
+	for i := 0; i < len(tests); i++ {
+		if !tests[i].Equal(results[i]) {
+			t.Errorf("Result wrong at %d instruction: expect %s, got %s",i+1,
+				tests[i].ToString(),results[i].ToString())
+		}
+	}
+}
+
+func TestCheckRange(t *testing.T) {
+	tests := []struct {
+		inst Instruction
+		encoding int16
+		valid bool
+	} {
+		{Instruction{Command: operation.LINE,Args: []float64{32767,-32768,0,0}},WORD16,true},
+		{Instruction{Command: operation.LINE,Args: []float64{32767.4,0,0,0}},WORD16,true},
+		{Instruction{Command: operation.LINE,Args: []float64{32767.5,0,0,0}},WORD16,false},
+		{Instruction{Command: operation.LINE,Args: []float64{0,0,-40000,0}},WORD16,false},
+		{Instruction{Command: operation.LINE,Args: []float64{0,0,-40000,0}},WORD32,true},
+		{Instruction{Command: operation.LINE,Args: []float64{3e9,0,0,0}},WORD32,false},
+		{Instruction{Command: operation.LINE,Args: []float64{math.NaN(),0,0,0}},WORD32,false},
+	}
+	for _,test := range tests {
+		err := test.inst.CheckRange(test.encoding)
+		if (err == nil) != test.valid {
+			t.Errorf("Range check of %s with encoding %d, expect valid = %v, "+
+				"got error %v",test.inst.ToString(),test.encoding,test.valid,err)
+		}
+	}
+}
+
+func TestTextInstruction(t *testing.T) {
+	inst,err := NewTextInstruction(-10.4,20,ANCHOR_NORTH,ALIGN_RIGHT,"a \"b\"")
+	if err != nil {
+		t.Fatalf("Error in NewTextInstruction: %s",err.Error())
+	}
+	for _,encoding := range []int16{WORD16,WORD32} {
+		insts,err := DecodeInstructions(inst.Encode(encoding),encoding)
+		if err != nil || len(insts) != 1 || insts[0].Text != inst.Text ||
+			!reflect.DeepEqual(insts[0].Args,[]float64{-10,20,1,2}) {
+			t.Errorf("Wrong text decoded: %v %v",insts,err)
+		}
+	}
+	invalids := []struct {
+		anchor,align int16
+		text string
+	}{
+		{-1,ALIGN_LEFT,"a"},
+		{ANCHOR_BASE+1,ALIGN_LEFT,"a"},
+		{ANCHOR_BASE,ALIGN_RIGHT+1,"a"},
+		{ANCHOR_BASE,ALIGN_RIGHT,strings.Repeat("a",MaxTextLength+1)},
+	}
+	for _,test := range invalids {
+		if _,err := NewTextInstruction(0,0,test.anchor,test.align,
+			test.text); err == nil {
+			t.Errorf("Expect error for anchor %d, alignment %d and %d bytes",
+				test.anchor,test.align,len(test.text))
+		}
+	}
+
+	data := inst.Encode(WORD32)
+	// The anchor is the third word, after the command and the position
+	data[2+8+3] = 100
+	if _,err := DecodeInstructions(data,WORD32); !IsDecodeError(err,
+		INVALID_ARGUMENT) {
+		t.Errorf("Expect invalid anchor, got %v",err)
+	}
+	data = inst.Encode(WORD16)
+	if _,err := DecodeInstructions(data[:len(data)-1],WORD16); !IsDecodeError(
+		err,TRUNCATED) {
+		t.Errorf("Expect truncated text, got %v",err)
+	}
+}
+
+func TestPathInstruction(t *testing.T) {
+	inst,err := NewPathInstruction([]int16{MOVE,CURVE,LINE_STRIP,CYCLE,MOVE},
+		[]float64{0,0,1,1,2,1,3,0,3,-1,5,5})
+	if err != nil {
+		t.Fatalf("Error in NewPathInstruction: %s",err.Error())
+	}
+	expect := []float64{17,3,0,0,1,1,1,2,1,3,0,0,3,-1,2,3,5,5}
+	if !reflect.DeepEqual(inst.Args,expect) {
+		t.Errorf("Expect path %v, got %v",expect,inst.Args)
+	}
+	segments,err := PathSegments(inst.Args[1:])
+	if err != nil || len(segments) != 5 || segments[1].Tag != CURVE ||
+		!reflect.DeepEqual(segments[1].Coords,[]float64{1,1,2,1,3,0}) ||
+		len(segments[3].Coords) != 0 {
+		t.Errorf("Wrong segments of path: %v %v",segments,err)
+	}
+	invalids := map[string][]float64{
+		"empty path": {},
+		"does not start with a move": {float64(LINE_STRIP),0,0},
+		"invalid segment 9": {float64(MOVE),0,0,9,1,1},
+		"invalid segment 0.5": {float64(MOVE),0,0,0.5,1,1},
+		"incomplete segment at argument 3": {float64(MOVE),0,0,
+			float64(CURVE),1,1,2,2},
+	}
+	for reason,args := range invalids {
+		_,err := GetInstruction(operation.PATH,args)
+		if err == nil || !strings.Contains(err.Error(),reason) {
+			t.Errorf("Expect error with %s for %v, got %v",reason,args,err)
+		}
+	}
+	if _,err := NewPathInstruction([]int16{MOVE,LINE_STRIP},
+		[]float64{0,0,1}); err == nil {
+		t.Errorf("Expect error for missing coordinates")
+	}
+}
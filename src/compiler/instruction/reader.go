@@ -0,0 +1,337 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"compiler/operation"
+)
+
+// Reader decodes the instructions of a .anm file one at a time, so that
+// drawings of any size can be read with bounded memory. A file without the
+// header is read as written before the container, see DecodeFile.
+type Reader struct {
+	in         *bufio.Reader
+	header     *Header
+	legacy     bool
+	offset     int
+	read       int
+	style      *Style
+	crc        hash.Hash32
+	err        error
+	headLength float64
+	heads      []Instruction
+}
+
+// NewReader reads the header from the input, if there is one. Otherwise the
+// instructions are decoded with the legacy encoding.
+func NewReader(in io.Reader, legacyEncoding int16) (*Reader,error) {
+	r := &Reader{in: bufio.NewReader(in),crc: crc32.NewIEEE()}
+	magic,err := r.in.Peek(len(Magic))
+	if err != nil && err != io.EOF {
+		return nil,err
+	}
+	if !bytes.Equal(magic,Magic) {
+		r.legacy = true
+		r.header = NewHeader(legacyEncoding)
+		r.header.Version = 0
+		return r,nil
+	}
+	err = r.readHeader()
+	if err != nil {
+		return nil,err
+	}
+	return r,nil
+}
+
+// Reader.Header gives the header of the file. For a legacy file it is made
+// up, with version 0 and neither count nor bounding box.
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+// Reader.IsLegacy tells whether the file has no header
+func (r *Reader) IsLegacy() bool {
+	return r.legacy
+}
+
+// Reader.SetArrowHeads makes Next give the arrowheads of each instruction
+// with arrows as instructions right after it, see ArrowHeads, with the length
+// in units. This is for the consumers which do not draw arrow tips
+// themselves. They are not counted in the header. A length of 0, the
+// default, gives no arrowheads.
+func (r *Reader) SetArrowHeads(length float64) {
+	r.headLength = length
+}
+
+// Reader.Offset gives the number of bytes consumed so far
+func (r *Reader) Offset() int {
+	return r.offset
+}
+
+// Reader.readBytes reads exactly n bytes, and reports a DecodeError if the
+// input ends before. The buffer grows with the data actually read, so a
+// corrupted size does not allocate in advance.
+func (r *Reader) readBytes(n int, field string) ([]byte,error) {
+	var buf bytes.Buffer
+	copied,err := io.CopyN(&buf,r.in,int64(n))
+	r.crc.Write(buf.Bytes())
+	r.offset += int(copied)
+	if err == io.EOF {
+		return nil,NewDecodeError(TRUNCATED,r.offset,fmt.Sprintf(
+			"truncated file: ends in %s, file has %d bytes",field,r.offset))
+	}
+	return buf.Bytes(),err
+}
+
+func (r *Reader) readUint16(field string) (uint16,error) {
+	b,err := r.readBytes(2,field)
+	if err != nil {
+		return 0,err
+	}
+	return binary.BigEndian.Uint16(b),nil
+}
+
+func (r *Reader) readUint32(field string) (uint32,error) {
+	b,err := r.readBytes(4,field)
+	if err != nil {
+		return 0,err
+	}
+	return binary.BigEndian.Uint32(b),nil
+}
+
+func (r *Reader) readFloat64(field string) (float64,error) {
+	b,err := r.readBytes(8,field)
+	if err != nil {
+		return 0,err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)),nil
+}
+
+func (r *Reader) readString(field string) (string,error) {
+	n,err := r.readUint16(field)
+	if err != nil {
+		return "",err
+	}
+	b,err := r.readBytes(int(n),field)
+	return string(b),err
+}
+
+// Reader.readHeader reads the header in the layout described at Header
+func (r *Reader) readHeader() error {
+	header := new(Header)
+	_,err := r.readBytes(len(Magic),"magic number")
+	if err != nil {
+		return err
+	}
+	header.Version,err = r.readUint16("version")
+	if err != nil {
+		return err
+	}
+	if header.Version < MinFormatVersion || header.Version > FormatVersion {
+		return NewDecodeError(UNSUPPORTED_VERSION,r.offset-2,fmt.Sprintf(
+			"unsupported format version %d, expect %d to %d",
+			header.Version,MinFormatVersion,FormatVersion))
+	}
+	encoding,err := r.readUint16("encoding")
+	if err != nil {
+		return err
+	}
+	header.Encoding = int16(encoding)
+	if header.Encoding != WORD16 && header.Encoding != WORD32 {
+		return NewDecodeError(UNKNOWN_ENCODING,r.offset-2,fmt.Sprintf(
+			"unknown coordinate encoding %d",header.Encoding))
+	}
+	header.Unit,err = r.readFloat64("unit")
+	if err != nil {
+		return err
+	}
+	if !(header.Unit > 0 && header.Unit <= math.MaxFloat64) {
+		return NewDecodeError(INVALID_UNIT,r.offset-8,fmt.Sprintf(
+			"invalid unit %g",header.Unit))
+	}
+	for _,v := range []*float64{&header.MinX,&header.MinY,
+		&header.MaxX,&header.MaxY} {
+		*v,err = r.readFloat64("bounding box")
+		if err != nil {
+			return err
+		}
+	}
+	entries,err := r.readUint16("metadata")
+	if err != nil {
+		return err
+	}
+	header.Metadata = map[string]string{}
+	for i := 0; i < int(entries); i++ {
+		key,err := r.readString("metadata")
+		if err != nil {
+			return err
+		}
+		header.Metadata[key],err = r.readString("metadata")
+		if err != nil {
+			return err
+		}
+	}
+	count,err := r.readUint32("instruction count")
+	if err != nil {
+		return err
+	}
+	header.Count = int(count)
+	r.header = header
+	return nil
+}
+
+// Reader.Next gives the next instruction, or io.EOF after the last one, and
+// the arrowheads after the instruction if asked, see SetArrowHeads. For a
+// file with a header, the checksum is verified before io.EOF is returned.
+// After an error, the same error is returned by any further call.
+func (r *Reader) Next() (Instruction,error) {
+	if r.err != nil {
+		return NewInstruction(),r.err
+	}
+	if len(r.heads) > 0 {
+		head := r.heads[0]
+		r.heads = r.heads[1:]
+		return head,nil
+	}
+	inst,err := r.next()
+	if err != nil {
+		r.err = err
+		return inst,err
+	}
+	if r.headLength > 0 {
+		r.heads = ArrowHeads(inst,r.headLength)
+	}
+	return inst,nil
+}
+
+// Reader.next reads records until an instruction, which is given the style
+// of the last STYLE record before it
+func (r *Reader) next() (Instruction,error) {
+	for {
+		if !r.legacy && r.read == r.header.Count {
+			return NewInstruction(),r.finish()
+		}
+		if r.legacy {
+			if _,err := r.in.Peek(1); err == io.EOF {
+				return NewInstruction(),io.EOF
+			}
+		}
+		start := r.offset
+		inst,err := r.readInstruction()
+		if IsDecodeError(err,TRUNCATED) && !r.legacy {
+			return inst,NewDecodeError(TRUNCATED,start,fmt.Sprintf(
+				"truncated file: %d of %d instructions complete",
+				r.read,r.header.Count))
+		}
+		if err != nil {
+			return inst,err
+		}
+		if inst.Command == operation.STYLE {
+			r.style = inst.Style
+			continue
+		}
+		inst.Style = r.style
+		r.read++
+		return inst,nil
+	}
+}
+
+// Reader.readInstruction reads the bytes of one instruction, finding out
+// their number like decodeInstruction does, and then decodes them with it.
+// The text of a TEXT is read after the arguments.
+func (r *Reader) readInstruction() (Instruction,error) {
+	start := r.offset
+	encoding := r.header.Encoding
+	buf,err := r.readBytes(2,"instruction")
+	if err != nil {
+		return NewInstruction(),err
+	}
+	command := int16(binary.BigEndian.Uint16(buf))
+	commandType := operation.GetType(command)
+	if !isRecord(command) {
+		return NewInstruction(),NewDecodeError(INVALID_COMMAND,start,
+			fmt.Sprintf("invalid command number %d",command))
+	}
+	argNum := recordArgNum(command,r.header.Version)
+	if commandType == operation.DRAW_UNDETERMINED {
+		b,err := r.readBytes(wordSize(encoding),"instruction")
+		if err != nil {
+			return NewInstruction(),err
+		}
+		buf = append(buf,b...)
+		pos := 2
+		length,_ := getWord(buf,&pos,encoding)
+		argNum = int(length)
+		err = checkLength(command,argNum)
+		if err != nil {
+			return NewInstruction(),NewDecodeError(INVALID_LENGTH,start+2,
+				err.Error())
+		}
+	}
+	b,err := r.readBytes(argNum*wordSize(encoding),"instruction")
+	if err != nil {
+		return NewInstruction(),err
+	}
+	buf = append(buf,b...)
+	if commandType == operation.DRAW_TEXT {
+		length,err := r.readUint16("instruction")
+		if err != nil {
+			return NewInstruction(),err
+		}
+		b,err = r.readBytes(int(length),"instruction")
+		if err != nil {
+			return NewInstruction(),err
+		}
+		buf = binary.BigEndian.AppendUint16(buf,length)
+		buf = append(buf,b...)
+	}
+	pos := 0
+	inst,err := decodeInstruction(buf,&pos,encoding,r.header.Version)
+	if e,ok := err.(*DecodeError); ok {
+		e.Offset += start
+	}
+	return inst,err
+}
+
+// Reader.finish checks the checksum after the last instruction, and that
+// nothing follows it
+func (r *Reader) finish() error {
+	expect := r.crc.Sum32()
+	start := r.offset
+	checksum,err := r.readUint32("checksum")
+	if err != nil {
+		return err
+	}
+	if checksum != expect {
+		return NewDecodeError(BAD_CHECKSUM,start,
+			"corrupted file: checksum mismatch")
+	}
+	if _,err := r.in.Peek(1); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return NewDecodeError(TRAILING_DATA,r.offset,fmt.Sprintf(
+			"unexpected bytes after %d instructions",r.header.Count))
+	}
+	return io.EOF
+}
@@ -0,0 +1,128 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import "testing"
+import "bytes"
+import "errors"
+import "io"
+import "reflect"
+import "testing/iotest"
+import "compiler/operation"
+
+func readAll(t *testing.T,data []byte,legacyEncoding int16) []Instruction {
+	r,err := NewReader(iotest.OneByteReader(bytes.NewReader(data)),
+		legacyEncoding)
+	if err != nil {
+		t.Fatalf("Error in NewReader: %s",err.Error())
+	}
+	insts := []Instruction{}
+	for {
+		inst,err := r.Next()
+		if err == io.EOF {
+			return insts
+		}
+		if err != nil {
+			t.Fatalf("Error in Reader.Next: %s",err.Error())
+		}
+		insts = append(insts,inst)
+	}
+}
+
+func TestReader(t *testing.T) {
+	// Far more than the 64 KiB atikz used to read at once
+	large := []Instruction{}
+	for i := 0; len(large) < 20000; i++ {
+		large = append(large,Instruction{Command: operation.LINE,
+			Args: []float64{float64(i%100),0,-float64(i%1000),100000}})
+	}
+	for _,insts := range [][]Instruction{containerTests,large} {
+		header := NewHeader(WORD32)
+		header.Metadata["source"] = "lines.adr"
+		if result := readAll(t,encodeFile(t,header,insts),WORD16);
+			!reflect.DeepEqual(result,insts) {
+			t.Errorf("Wrong instructions read from container")
+		}
+	}
+	if result := readAll(t,legacyFile,WORD16);
+		!reflect.DeepEqual(result,legacyInsts) {
+		t.Errorf("Wrong instructions read from legacy file: %v",result)
+	}
+
+	data := encodeFile(t,NewHeader(WORD16),containerTests)
+	r,err := NewReader(bytes.NewReader(data),WORD16)
+	if err != nil || r.IsLegacy() || r.Header().Count != 5 ||
+		r.Header().MaxY != 310 {
+		t.Fatalf("Wrong header read: %v %v",r,err)
+	}
+}
+
+func TestReaderArrowHeads(t *testing.T) {
+	data := encodeFile(t,NewHeader(WORD16),containerTests)
+	r,err := NewReader(bytes.NewReader(data),WORD16)
+	if err != nil {
+		t.Fatalf("Error in NewReader: %s",err.Error())
+	}
+	r.SetArrowHeads(10)
+	insts := []Instruction{}
+	for {
+		inst,err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error in Reader.Next: %s",err.Error())
+		}
+		insts = append(insts,inst)
+	}
+	// Only the line has an arrow, the text has none though in the same style
+	heads := ArrowHeads(containerTests[1],10)
+	expect := append(append(append([]Instruction{},containerTests[:2]...),
+		heads...),containerTests[2:]...)
+	if len(heads) != 1 || !reflect.DeepEqual(insts,expect) {
+		t.Errorf("Expect instructions %v, got %v",expect,insts)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	data := encodeFile(t,NewHeader(WORD16),containerTests)
+	r,err := NewReader(bytes.NewReader(data[:len(data)-20]),WORD16)
+	if err != nil {
+		t.Fatalf("Error in NewReader: %s",err.Error())
+	}
+	// The text, the line and the path come before the polygon
+	r.Next()
+	r.Next()
+	r.Next()
+	_,err = r.Next()
+	// The polygon of 16 bytes comes before the oval of 14 and the checksum
+	if !IsDecodeError(err,TRUNCATED) ||
+		err.(*DecodeError).Offset != len(data)-4-14-16 {
+		t.Errorf("Expect truncation in the polygon, got %v",err)
+	}
+	if _,again := r.Next(); again != err {
+		t.Errorf("Expect the same error again, got %v",again)
+	}
+
+	failure := errors.New("disk on fire")
+	in := io.MultiReader(bytes.NewReader(data[:60]),iotest.ErrReader(failure))
+	r,err = NewReader(in,WORD16)
+	if err == nil {
+		_,err = r.Next()
+	}
+	if err != failure {
+		t.Errorf("Expect error of the input, got %v",err)
+	}
+}
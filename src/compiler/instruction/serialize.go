@@ -15,53 +15,222 @@
 package instruction
 
 import (
+	"fmt"
+	"math"
 	"strconv"
 	"compiler/operation"
 )
 
 func InstructionsToBytes(insts []Instruction) []byte {
+	return EncodeInstructions(insts,WORD16)
+}
+
+// EncodeInstructions writes the instructions one after another, each
+// preceded by a STYLE record if its style differs from the one before, see
+// Style.
+func EncodeInstructions(insts []Instruction, encoding int16) []byte {
 	ret := []byte{}
+	var style *Style
 	for _, inst := range insts {
-		ret = append(ret, inst.ToBytes()...)
+		if !sameStyle(inst.Style, style) {
+			record := Instruction{Command: operation.STYLE,
+				Args: inst.Style.OrDefault().words()}
+			ret = append(ret, record.Encode(encoding)...)
+			style = inst.Style
+		}
+		ret = append(ret, inst.Encode(encoding)...)
 	}
 	return ret
 }
 
 func BytesToInstructions(data []byte) ([]Instruction,error) {
+	return DecodeInstructions(data,WORD16)
+}
+
+// DecodeInstructions reads the instructions written by EncodeInstructions
+// with the same encoding, which is not recorded in the data. Headerless files
+// of the compiler before the container have other records, and are read by
+// DecodeFile.
+func DecodeInstructions(data []byte, encoding int16) ([]Instruction,error) {
 	ptr := 0
 	ret := []Instruction{}
+	var style *Style
 	for {
-		if ptr*2+1 >= len(data) {
+		if ptr == len(data) {
 			return ret,nil
 		}
-
-		command,err := getInt16(data,&ptr)
-		commandType := operation.GetType(command)
-		if commandType != operation.DRAW_FIXED &&
-			commandType != operation.DRAW_UNDETERMINED {
-			return ret,NewInstructionError(
-				"Invalid command number "+strconv.Itoa(int(command)))
+		inst,err := decodeInstruction(data,&ptr,encoding,FormatVersion)
+		if err != nil {
+			return ret,err
 		}
-
-		var argNum int16
-		if commandType == operation.DRAW_FIXED {
-			argNum = int16(operation.FinalArgNum(command))
-		} else {
-			argNum,err = getInt16(data,&ptr)
-			if err != nil {
-				return ret,err
-			}
+		if inst.Command == operation.STYLE {
+			style = inst.Style
+			continue
 		}
+		inst.Style = style
+		ret = append(ret,inst)
+	}
+}
 
-		args,err := getInts16(data,&ptr,int(argNum))
+// decodeInstruction reads one instruction at the byte offset and moves the
+// offset past it. Errors are DecodeErrors with the offset of the part at
+// fault, and nothing is allocated before its size is checked against the
+// data left. A STYLE record is given as an instruction with only the Style,
+// which the caller applies to the instructions after it. The version of the
+// file tells the size of the STYLE record, see recordArgNum.
+func decodeInstruction(data []byte, ptr *int,
+	encoding int16, version uint16) (Instruction,error) {
+	start := *ptr
+	command,err := getInt16(data,ptr)
+	if err != nil {
+		return NewInstruction(),err
+	}
+	commandType := operation.GetType(command)
+	if !isRecord(command) {
+		return NewInstruction(),NewDecodeError(INVALID_COMMAND,start,
+			"invalid command number "+strconv.Itoa(int(command)))
+	}
+
+	argNum := recordArgNum(command,version)
+	if commandType == operation.DRAW_UNDETERMINED {
+		lengthAt := *ptr
+		length,err := getWord(data,ptr,encoding)
 		if err != nil {
-			return ret,err
+			return NewInstruction(),err
 		}
-		inst,err := GetInstruction(command,args)
+		argNum = int(length)
+		err = checkLength(command,argNum)
 		if err != nil {
-			return ret,err
+			return NewInstruction(),NewDecodeError(INVALID_LENGTH,lengthAt,
+				err.Error())
 		}
-		ret = append(ret,inst)
 	}
-	return ret,nil
+	if need := argNum*wordSize(encoding); need > len(data)-*ptr {
+		return NewInstruction(),truncatedError(data,*ptr)
+	}
+
+	args,err := getWords(data,ptr,argNum,encoding)
+	if err != nil {
+		return NewInstruction(),err
+	}
+	if commandType == operation.DRAW_TEXT {
+		return decodeText(data,ptr,start,args)
+	}
+	if command == operation.STYLE {
+		return decodeStyle(args,start)
+	}
+	if command == operation.OVAL && len(args) == legacyOvalWords {
+		args = legacyOval(args)
+	}
+	inst,err := GetInstruction(command,args)
+	if err != nil && command == operation.PATH {
+		return NewInstruction(),NewDecodeError(INVALID_ARGUMENT,start,err.Error())
+	} else if err != nil {
+		return NewInstruction(),NewDecodeError(INVALID_LENGTH,start,err.Error())
+	}
+	return inst,nil
+}
+
+// decodeText reads the text after the arguments of a TEXT, which starts at
+// the offset start
+func decodeText(data []byte, ptr *int, start int,
+	args []float64) (Instruction,error) {
+	length,err := getInt16(data,ptr)
+	if err != nil {
+		return NewInstruction(),err
+	}
+	size := int(uint16(length))
+	if size > len(data)-*ptr {
+		return NewInstruction(),truncatedError(data,*ptr)
+	}
+	text := string(data[*ptr:*ptr+size])
+	*ptr += size
+	inst,err := NewTextInstruction(args[0],args[1],code(args[2]),code(args[3]),
+		text)
+	if err != nil {
+		return NewInstruction(),NewDecodeError(INVALID_ARGUMENT,start,
+			err.Error())
+	}
+	return inst,nil
+}
+
+// decodeStyle makes the STYLE record at the offset start from its words. A
+// record of version 1 has no arrow and head, which are left as the default.
+func decodeStyle(args []float64, start int) (Instruction,error) {
+	style := DefaultStyle()
+	style.Stroke,style.Fill,style.Width = code(args[0]),code(args[1]),args[2]/100
+	style.Dash,style.Opacity = code(args[3]),args[4]/100
+	style.Cap,style.Join = code(args[5]),code(args[6])
+	if len(args) > styleWordsV1 {
+		style.Arrow,style.Head = code(args[7]),code(args[8])
+	}
+	err := style.Check()
+	if err != nil {
+		return NewInstruction(),NewDecodeError(INVALID_ARGUMENT,start,
+			"invalid style: "+err.Error())
+	}
+	inst := NewInstruction()
+	inst.Command = operation.STYLE
+	inst.Style = style.Ref()
+	return inst,nil
+}
+
+// legacyOvalWords is the number of words of an OVAL in the headerless files of
+// the compiler before ovals were centre and semi-diameters, see legacyOval
+const legacyOvalWords = 16
+
+// recordArgNum gives the number of words after the command word of a record
+// with a fixed number of them, in a file of the format version. Version 0 is
+// a headerless file, written before the container, whose ovals have the old
+// layout.
+func recordArgNum(command int16, version uint16) int {
+	if command == operation.STYLE && version == 1 {
+		return styleWordsV1
+	}
+	if command == operation.OVAL && version == 0 {
+		return legacyOvalWords
+	}
+	return operation.FinalArgNum(command)
+}
+
+// legacyOval converts the words of an old OVAL to the centre and the
+// semi-diameters. They are the images of the eight points around the oval
+// from x+a y, counterclockwise through the corners of its bounding box, so
+// that the first and fifth are the ends of one semi-diameter and the third
+// and seventh of the other.
+func legacyOval(args []float64) []float64 {
+	return []float64{(args[0]+args[8])/2,(args[1]+args[9])/2,
+		(args[0]-args[8])/2,(args[1]-args[9])/2,
+		(args[4]-args[12])/2,(args[5]-args[13])/2}
+}
+
+// code narrows a decoded word to the number of a name, like an anchor or a
+// color. They are small, anything else is made invalid before it is narrowed
+// to int16.
+func code(v float64) int16 {
+	if v < 0 || v > math.MaxInt8 {
+		return -1
+	}
+	return int16(v)
+}
+
+// checkLength checks the number of coordinates of an instruction with
+// variable length, before anything is allocated for them
+func checkLength(command int16, length int) error {
+	name := operation.GetName(command)
+	if command == operation.PATH {
+		// At least a move, the segments are checked when decoded
+		if length < 1+segmentSizes[MOVE] {
+			return NewInstructionError(fmt.Sprintf(
+				"invalid number of arguments %d for %s",length,name))
+		}
+	} else if length < 4 || length%2 == 1 {
+		return NewInstructionError(fmt.Sprintf(
+			"invalid number of arguments %d for %s",length,name))
+	}
+	if length > MaxPolygonArgs {
+		return NewInstructionError(fmt.Sprintf(
+			"%d arguments for %s exceed the limit %d",length,name,MaxPolygonArgs))
+	}
+	return nil
 }
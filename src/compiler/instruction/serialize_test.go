@@ -0,0 +1,86 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import "testing"
+import "reflect"
+import "compiler/operation"
+
+func TestDecodeMalformed(t *testing.T) {
+	line := InstructionsToBytes([]Instruction{
+		{Command: operation.LINE,Args: []float64{1,2,3,4}}})
+	tests := []struct {
+		data []byte
+		encoding int16
+		kind int16
+		offset int
+	} {
+		{[]byte{0,1,0},WORD16,TRUNCATED,2},
+		{append(append([]byte{},line...),0),WORD16,TRUNCATED,10},
+		{[]byte{0,99},WORD16,INVALID_COMMAND,0},
+		{append(append([]byte{},line...),0xff,0xff),WORD16,INVALID_COMMAND,10},
+		{[]byte{0,4,0xff,0xfe,0,0,0,0},WORD16,INVALID_LENGTH,2},
+		{[]byte{0,4,0,3,0,0,0,0,0,0},WORD16,INVALID_LENGTH,2},
+		{[]byte{0,4,0x7f,0xfe,0,0,0,0},WORD16,TRUNCATED,4},
+		{[]byte{0,4,0x7f,0xff,0xff,0xfe,0,0,0,0},WORD32,INVALID_LENGTH,2},
+		{[]byte{0,1,0,0,0,1},WORD32,TRUNCATED,2},
+		{[]byte{0,byte(operation.POLYLINE),0,3,0,0,0,0,0,0},WORD16,
+			INVALID_LENGTH,2},
+		// Paths too short, not starting with a move, and with a curve cut off
+		{[]byte{0,byte(operation.PATH),0,2,0,3,0,0},WORD16,INVALID_LENGTH,2},
+		{[]byte{0,byte(operation.PATH),0,3,0,0,0,0,0,0},WORD16,
+			INVALID_ARGUMENT,0},
+		{[]byte{0,byte(operation.PATH),0,4,0,3,0,0,0,0,0,1},WORD16,
+			INVALID_ARGUMENT,0},
+	}
+	for i,test := range tests {
+		_,err := DecodeInstructions(test.data,test.encoding)
+		e,ok := err.(*DecodeError)
+		if !ok || e.Kind != test.kind || e.Offset != test.offset {
+			t.Errorf("Test %d: expect error of kind %d at byte %d, got %v",
+				i,test.kind,test.offset,err)
+		}
+	}
+}
+
+// FuzzDecodeInstructions checks that the decoder never panics, that it only
+// fails with a DecodeError inside the data, and that whatever it accepts is
+// encoded back to the same instructions. The bytes may differ, as STYLE
+// records that change nothing are dropped.
+func FuzzDecodeInstructions(f *testing.F) {
+	f.Add(InstructionsToBytes(containerTests),false)
+	f.Add(EncodeInstructions(containerTests,WORD32),true)
+	f.Add([]byte{0,4,0x7f,0xfe,0,0},false)
+	f.Add([]byte{0,4,0xff,0xff,0xff,0xfe},true)
+	f.Fuzz(func(t *testing.T, data []byte, wide bool) {
+		encoding := WORD16
+		if wide {
+			encoding = WORD32
+		}
+		insts,err := DecodeInstructions(data,encoding)
+		if err != nil {
+			e,ok := err.(*DecodeError)
+			if !ok || e.Offset < 0 || e.Offset > len(data) {
+				t.Fatalf("Unexpected error %v",err)
+			}
+			return
+		}
+		again := EncodeInstructions(insts,encoding)
+		if result,err := DecodeInstructions(again,encoding); err != nil ||
+			!reflect.DeepEqual(result,insts) {
+			t.Fatalf("Decoded %v from %x, which is encoded as %x",insts,data,again)
+		}
+	})
+}
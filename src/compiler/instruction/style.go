@@ -0,0 +1,191 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// MaxWidth is the widest line in units, as the width is stored in hundredths
+// of a unit in a 16-bit word
+const MaxWidth = math.MaxInt16/100.0
+
+/*
+Style is how an instruction is drawn. An instruction drawn in the default
+style, see DefaultStyle, has a nil Style.
+
+In the instruction stream, a STYLE record sets the style of the instructions
+after it, and is written only where the style changes, so a drawing without
+styles is stored as before. After the command word of STYLE it has nine
+words of the encoding,
+
+	stroke    color of the lines
+	fill      color of the inside
+	width     line width in hundredths of a unit, 0 for the default
+	dash      dash pattern
+	opacity   in percent
+	cap       shape of the ends of the lines
+	join      shape of the corners
+	arrow     ends of an open line with an arrowhead
+	head      shape of the arrowheads
+
+Files of format version 1 have only the first seven, and their instructions
+have no arrowheads. Width and opacity are rounded accordingly when stored.
+*/
+type Style struct {
+	Stroke  int16
+	Fill    int16
+	Width   float64
+	Dash    int16
+	Opacity float64
+	Cap     int16
+	Join    int16
+	Arrow   int16
+	Head    int16
+}
+
+// DefaultStyle gives the style of instructions without one, solid black lines
+// of the default width, not filled and without arrowheads
+func DefaultStyle() Style {
+	return Style{COLOR_BLACK,COLOR_NONE,0,DASH_SOLID,1,CAP_BUTT,JOIN_MITER,
+		ARROW_NONE,HEAD_TO}
+}
+
+// Style.OrDefault gives the style, or the default one if it is nil
+func (s *Style) OrDefault() Style {
+	if s == nil {
+		return DefaultStyle()
+	}
+	return *s
+}
+
+// Style.Ref gives the style to put in an instruction, which is nil for the
+// default one
+func (s Style) Ref() *Style {
+	if s == DefaultStyle() {
+		return nil
+	}
+	return &s
+}
+
+// sameStyle tells whether two styles of instructions are the same, where nil
+// is the default one
+func sameStyle(s1,s2 *Style) bool {
+	return s1.OrDefault() == s2.OrDefault()
+}
+
+// GetColor gives a color by its name, like red or none
+func GetColor(name string) (int16,bool) {
+	return lookupName(colorNames,name)
+}
+
+// GetDash gives a dash pattern by its name, solid, dashed, dotted or dashdot
+func GetDash(name string) (int16,bool) {
+	return lookupName(dashNames,name)
+}
+
+// GetCap gives a line cap by its name, butt, round or rect
+func GetCap(name string) (int16,bool) {
+	return lookupName(capNames,name)
+}
+
+// GetJoin gives a line join by its name, miter, round or bevel
+func GetJoin(name string) (int16,bool) {
+	return lookupName(joinNames,name)
+}
+
+// GetArrow gives the ends with an arrowhead by their name, none, start, end or
+// both
+func GetArrow(name string) (int16,bool) {
+	return lookupName(arrowNames,name)
+}
+
+// GetHead gives a shape of arrowheads by its name, to, stealth or latex
+func GetHead(name string) (int16,bool) {
+	return lookupName(headNames,name)
+}
+
+type styleCode struct {
+	field string
+	code  int16
+	names []string
+}
+
+func (s *Style) codes() []styleCode {
+	return []styleCode{
+		{"stroke",s.Stroke,colorNames},
+		{"fill",s.Fill,colorNames},
+		{"dash",s.Dash,dashNames},
+		{"cap",s.Cap,capNames},
+		{"join",s.Join,joinNames},
+		{"arrow",s.Arrow,arrowNames},
+		{"head",s.Head,headNames},
+	}
+}
+
+// Style.Check reports a field out of range, which could not be stored
+func (s *Style) Check() error {
+	for _,c := range s.codes() {
+		if c.code < 0 || int(c.code) >= len(c.names) {
+			return NewInstructionError(fmt.Sprintf("invalid %s %d",c.field,c.code))
+		}
+	}
+	if !(s.Width >= 0 && s.Width <= MaxWidth) {
+		return NewInstructionError(fmt.Sprintf(
+			"line width %g out of range [0,%g]",s.Width,MaxWidth))
+	}
+	if !(s.Opacity >= 0 && s.Opacity <= 1) {
+		return NewInstructionError(fmt.Sprintf(
+			"opacity %g out of range [0,1]",s.Opacity))
+	}
+	return nil
+}
+
+// Style.ToString gives the fields different from the default style, as the
+// options of the style operation
+func (s *Style) ToString() string {
+	def := DefaultStyle()
+	options := []string{}
+	for i,c := range s.codes() {
+		if c.code == def.codes()[i].code {
+			continue
+		}
+		name := fmt.Sprint(c.code)
+		if c.code >= 0 && int(c.code) < len(c.names) {
+			name = c.names[c.code]
+		}
+		options = append(options,c.field+"="+name)
+	}
+	if s.Width != def.Width {
+		options = append(options,fmt.Sprintf("width=%g",s.Width))
+	}
+	if s.Opacity != def.Opacity {
+		options = append(options,fmt.Sprintf("opacity=%g",s.Opacity))
+	}
+	return strings.Join(options," ")
+}
+
+// Style.words gives the words of the STYLE record after the command
+func (s Style) words() []float64 {
+	return []float64{float64(s.Stroke),float64(s.Fill),math.Round(s.Width*100),
+		float64(s.Dash),math.Round(s.Opacity*100),float64(s.Cap),float64(s.Join),
+		float64(s.Arrow),float64(s.Head)}
+}
+
+// styleWordsV1 is the number of words of a STYLE record in files of format
+// version 1, before the arrow and the head
+const styleWordsV1 = 7
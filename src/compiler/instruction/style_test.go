@@ -0,0 +1,79 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package instruction
+
+import "testing"
+import "reflect"
+import "strings"
+import "compiler/operation"
+
+func TestStyle(t *testing.T) {
+	if style := DefaultStyle(); style.Ref() != nil {
+		t.Errorf("Expect nil for the default style")
+	}
+	if testStyle.OrDefault().Ref() == nil {
+		t.Errorf("Expect a style different from the default")
+	}
+	expect := "stroke=red fill=blue dash=dashed cap=round join=bevel "+
+		"arrow=end head=stealth width=1.5 opacity=0.25"
+	if testStyle.ToString() != expect {
+		t.Errorf("Expect %s, got %s",expect,testStyle.ToString())
+	}
+
+	tests := map[string]Style{
+		"invalid stroke 20": {20,COLOR_NONE,0,DASH_SOLID,1,CAP_BUTT,JOIN_MITER,
+			ARROW_NONE,HEAD_TO},
+		"invalid join -1": {COLOR_RED,COLOR_NONE,0,DASH_SOLID,1,CAP_BUTT,-1,
+			ARROW_NONE,HEAD_TO},
+		"invalid head 3": {COLOR_RED,COLOR_NONE,0,DASH_SOLID,1,CAP_BUTT,
+			JOIN_MITER,ARROW_END,3},
+		"line width -1 out of range": {COLOR_RED,COLOR_NONE,-1,DASH_SOLID,1,
+			CAP_BUTT,JOIN_MITER,ARROW_NONE,HEAD_TO},
+		"opacity 1.5 out of range": {COLOR_RED,COLOR_NONE,0,DASH_SOLID,1.5,
+			CAP_BUTT,JOIN_MITER,ARROW_NONE,HEAD_TO},
+	}
+	for expect,style := range tests {
+		err := style.Check()
+		if err == nil || !strings.Contains(err.Error(),expect) {
+			t.Errorf("Expect error containing %s, got %v",expect,err)
+		}
+	}
+}
+
+func TestEncodeStyle(t *testing.T) {
+	line := Instruction{Command: operation.LINE,Args: []float64{0,0,10,10}}
+	styled := line
+	styled.Style = testStyle
+	// Records only where the style changes, and back to the default
+	insts := []Instruction{line,styled,styled,line}
+	data := EncodeInstructions(insts,WORD16)
+	if record := 2+9*2; len(data) != 4*len(line.ToBytes())+2*record {
+		t.Errorf("Expect two style records, got %d bytes",len(data))
+	}
+	result,err := BytesToInstructions(data)
+	if err != nil || !reflect.DeepEqual(result,insts) {
+		t.Errorf("Wrong instructions decoded: %v %v",result,err)
+	}
+
+	// An opacity of 200 percent
+	record := Instruction{Command: operation.STYLE,
+		Args: []float64{1,0,0,0,200,0,0,0,0}}
+	data = append(record.ToBytes(),line.ToBytes()...)
+	_,err = BytesToInstructions(data)
+	if !IsDecodeError(err,INVALID_ARGUMENT) ||
+		!strings.Contains(err.Error(),"opacity 2 out of range") {
+		t.Errorf("Expect invalid opacity, got %v",err)
+	}
+}
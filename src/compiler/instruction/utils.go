@@ -14,24 +14,92 @@
 // along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
 package instruction
 
-func composeBytes(b1,b2 byte) int16 {
-	return int16(uint(b1)*256+uint(b2))
+import (
+	"fmt"
+	"compiler/operation"
+)
+
+// MaxPolygonArgs limits the number of coordinates of a polygon, polyline or
+// path that a decoder accepts, so that a corrupted length does not make it allocate without end
+var MaxPolygonArgs = 1 << 20
+
+// MaxTextLength is the number of bytes of the longest text, whose length is
+// stored as a 16-bit word
+const MaxTextLength = 65535
+
+// isDrawing tells whether the command is one of the instructions
+func isDrawing(command int16) bool {
+	switch operation.GetType(command) {
+	case operation.DRAW_FIXED,operation.DRAW_UNDETERMINED,operation.DRAW_TEXT:
+		return true
+	}
+	return false
+}
+
+// isRecord tells whether the command may appear in an instruction stream,
+// i.e. it is an instruction or the STYLE applied to the instructions after it
+func isRecord(command int16) bool {
+	return isDrawing(command) || command == operation.STYLE
 }
 
-func getInt16(data []byte, i *int) (int16,error) {
-	if (*i)*2+1 >= len(data) {
-		return 0,NewInstructionError("index out of range")
+// lookupName gives the number of a name in the table
+func lookupName(names []string, name string) (int16,bool) {
+	for i,v := range names {
+		if v == name {
+			return int16(i),true
+		}
 	}
-	ret := composeBytes(data[(*i)*2],data[(*i)*2+1])
-	(*i)++
+	return 0,false
+}
+
+func wordSize(encoding int16) int {
+	if encoding == WORD32 {
+		return 4
+	}
+	return 2
+}
+
+// getInt16 reads a big-endian int16 word at the byte offset and moves the
+// offset past it
+func getInt16(data []byte, pos *int) (int16,error) {
+	if *pos+1 >= len(data) {
+		return 0,truncatedError(data,*pos)
+	}
+	ret := int16(uint16(data[*pos])<<8 | uint16(data[*pos+1]))
+	*pos += 2
 	return ret,nil
 }
 
-func getInts16(data []byte, ptr *int, count int) ([]int16,error) {
-	ret := make([]int16,count)
+// getWord reads a coordinate of the encoding
+func getWord(data []byte, pos *int, encoding int16) (float64,error) {
+	if encoding != WORD32 {
+		word,err := getInt16(data,pos)
+		return float64(word),err
+	}
+	if *pos+3 >= len(data) {
+		return 0,truncatedError(data,*pos)
+	}
+	var word uint32
+	for j := 0; j < 4; j++ {
+		word = word<<8 | uint32(data[*pos+j])
+	}
+	*pos += 4
+	return float64(int32(word)),nil
+}
+
+func truncatedError(data []byte, pos int) error {
+	return NewDecodeError(TRUNCATED,pos,fmt.Sprintf(
+		"unexpected end of data, %d bytes in total",len(data)))
+}
+
+// getWords reads count coordinates of the encoding. The count must have been
+// checked against the size of the data, see checkLength.
+func getWords(data []byte, pos *int, count int,
+	encoding int16) ([]float64,error) {
+	ret := make([]float64,count)
 	var err error
 	for i := 0; i < count; i++ {
-		ret[i],err = getInt16(data,ptr)
+		ret[i],err = getWord(data,pos,encoding)
 		if err != nil {
 			return ret,err
 		}
@@ -39,12 +107,12 @@ func getInts16(data []byte, ptr *int, count int) ([]int16,error) {
 	return ret,err
 }
 
-func addLengthPrefix(args []int16) []int16 {
-	return append([]int16{int16(len(args))},args...)
+func addLengthPrefix(args []float64) []float64 {
+	return append([]float64{float64(len(args))},args...)
 }
 
-func expandRect(args []int16) []int16 {
-	ret := make([]int16,8)
+func expandRect(args []float64) []float64 {
+	ret := make([]float64,8)
 	ret[0],ret[1] = args[0],args[1]
 	ret[2],ret[3] = args[0],args[3]
 	ret[4],ret[5] = args[2],args[3]
@@ -52,16 +120,8 @@ func expandRect(args []int16) []int16 {
 	return ret
 }
 
-func expandOval(args []int16) []int16 {
-	ret := make([]int16,16)
-	x,y,a,b := args[0],args[1],args[2],args[3]
-	ret[0],ret[1] = x+a,y
-	ret[2],ret[3] = x+a,y+b
-	ret[4],ret[5] = x,y+b
-	ret[6],ret[7] = x-a,y+b
-	ret[8],ret[9] = x-a,y
-	ret[10],ret[11] = x-a,y-b
-	ret[12],ret[13] = x,y-b
-	ret[14],ret[15] = x+a,y-b
-	return ret
+// expandOval gives the centre and the two conjugate semi-diameters of the
+// untransformed oval
+func expandOval(args []float64) []float64 {
+	return []float64{args[0],args[1],args[2],0,0,args[3]}
 }
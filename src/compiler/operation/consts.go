@@ -33,14 +33,53 @@ const (
 	IMPORT
 	BEGIN
 	END
+	FOR
+	IF
+	ELSE
+	FLIPX
+	FLIPY
+	FLIPXY
+	SCALEX
+	SCALEY
+	SCALEXY
+	COMBINE
+	INVERT
+	POWER
+	SHEAR
+	ROTATEABOUT
+	MIRROR
+	HOMOGRAPHY
+	MAP
+	TEXT
+	STYLE
+	GSAVE
+	GRESTORE
+	PATH
+	POLYLINE
+	CIRCLE
+	ARC
+	SECTOR
+	ELLIPTICARC
+	ROUNDRECT
+	NGON
+	STARPOLY
+	POINT
+	MIDPOINT
+	OFFSET
+	LERP
+	APPLY
 )
 
 // Value types
 const (
 	VARIABLE int16 = iota
-	INTEGER
+	FLOAT
 	TRANSFORMER
+	EXPRESSION
 	NAN
+	STRING
+	PAIR
+	PARAMETER
 )
 
 // Operation types
@@ -51,6 +90,13 @@ const (
 	ASSIGN
 	SINGLE
 	STATE
+	INVOKE
+	BLOCK
+	BRANCH
+	DRAW_TEXT
+	STYLING
+	DRAW_SHAPE
+	DRAW_OPTIONAL
 )
 
 // Consts for parsers
@@ -59,6 +105,28 @@ const (
 	COMMAND
 	NAME
 	NUMBER
+	FORMULA
+	QUOTED
+)
+
+// Expression operators
+const (
+	NO_OPERATOR int16 = iota
+	PLUS
+	MINUS
+	TIMES
+	DIVIDE
+	MODULO
+	NEGATE
+	LESS
+	LESS_EQUAL
+	GREATER
+	GREATER_EQUAL
+	EQUAL
+	NOT_EQUAL
+	AND
+	OR
+	NOT
 )
 
 const (
@@ -72,37 +140,65 @@ const (
 var operationNames = []string{
 	"undefined", "line", "rect", "oval", "polygon", "set", "use",
 	"push", "pop", "transform", "rotate", "scale", "translate", "draw", "import",
-	"begin", "end",
+	"begin", "end", "for", "if", "else", "flipx", "flipy", "flipxy", "scalex",
+	"scaley", "scalexy", "combine", "invert", "power", "shear", "rotateabout",
+	"mirror", "homography", "map", "text", "style", "gsave", "grestore",
+	"path", "polyline", "circle", "arc", "sector", "ellipticarc", "roundrect",
+	"ngon", "starpoly", "point", "midpoint", "offset", "lerp", "apply",
 }
 
 var operationTypes = []int16{
 	NOT_OPERATION, DRAW_FIXED, DRAW_FIXED, DRAW_FIXED, DRAW_UNDETERMINED,
-	ASSIGN, STATE, STATE, SINGLE, ASSIGN, ASSIGN, ASSIGN, ASSIGN, STATE, STATE,
-	STATE, SINGLE,
+	ASSIGN, STATE, STATE, SINGLE, ASSIGN, ASSIGN, ASSIGN, ASSIGN, INVOKE, INVOKE,
+	INVOKE, SINGLE, BLOCK, BRANCH, SINGLE, ASSIGN, ASSIGN, ASSIGN, ASSIGN,
+	ASSIGN, ASSIGN, ASSIGN, ASSIGN, ASSIGN, ASSIGN, ASSIGN, ASSIGN, ASSIGN,
+	ASSIGN, DRAW_TEXT, STYLING, SINGLE, SINGLE, DRAW_UNDETERMINED,
+	DRAW_UNDETERMINED, DRAW_SHAPE, DRAW_SHAPE, DRAW_SHAPE, DRAW_SHAPE,
+	DRAW_SHAPE, DRAW_OPTIONAL, DRAW_OPTIONAL, ASSIGN, ASSIGN, ASSIGN, ASSIGN,
+	ASSIGN,
 }
 
 var expectName = []bool{
-	false, false, false, true, false, true,
+	false, false, false, true, false, true, true, true, false, false, false,
+	false, false,
 }
 
 var expectArgNum = []int{
 	0, 4, 4, 4, 0, 1, 0,
-	0, 0, 6, 1, 2, 2, 0, 0,
-	0, 0,
+	0, 0, 6, 1, 2, 2, 0, 1,
+	0, 0, 3, 1, 0, 0, 0, 0, 1,
+	1, 2, 2, 1, 2, 2, 3, 4, 16,
+	12, 0, 0, 0, 0, 0, 0, 3, 5, 5, 6, 5,
+	5, 6, 2, 2, 3, 3, 2,
 }
 
 var expectArgs = []bool{
-	false, true, true, true, false, false,
+	false, true, true, true, false, false, true, true, true, true, true,
+	true, true,
 }
 
 var needArgNum = []bool{
-	false, false, true, false, false, false,
+	false, false, true, false, false, false, true, true, false, true, true,
+	false, true,
 }
 
 var finalArgNum = []int{
-	0, 4, 8,16, 0, 1, 0,
-	0, 0, 6, 1, 2, 2, 0, 0,
-	0, 0,
+	0, 4, 8, 6, 0, 1, 0,
+	0, 0, 6, 1, 2, 2, 0, 1,
+	0, 0, 3, 1, 0, 0, 0, 0, 1,
+	1, 2, 2, 1, 2, 2, 3, 4, 16,
+	12, 4, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 2, 2, 3, 3, 2,
+}
+
+// The segments of PATH, with the number of coordinates after each keyword
+var pathSegments = map[string]int{
+	"move": 2, "line": 2, "quad": 4, "cubic": 6, "close": 0,
+}
+
+var operatorSymbols = []string{
+	"", "+", "-", "*", "/", "%", "-",
+	"<", "<=", ">", ">=", "==", "!=", "&&", "||", "!",
 }
 
 var operationNameMap = map[string]int16{
@@ -110,5 +206,14 @@ var operationNameMap = map[string]int16{
 	"oval": OVAL, "polygon": POLYGON, "set": SET, "use": USE, "push": PUSH,
 	"pop": POP, "transform": TRANSFORM, "rotate": ROTATE, "scale": SCALE,
 	"translate": TRANSLATE,"draw": DRAW, "import": IMPORT, "begin": BEGIN,
-	"end": END,
+	"end": END, "for": FOR, "if": IF, "else": ELSE, "flipx": FLIPX,
+	"flipy": FLIPY, "flipxy": FLIPXY, "scalex": SCALEX, "scaley": SCALEY,
+	"scalexy": SCALEXY, "combine": COMBINE, "invert": INVERT, "power": POWER,
+	"shear": SHEAR, "rotateabout": ROTATEABOUT, "mirror": MIRROR,
+	"homography": HOMOGRAPHY, "map": MAP, "text": TEXT, "style": STYLE,
+	"gsave": GSAVE, "grestore": GRESTORE, "path": PATH,
+	"polyline": POLYLINE, "circle": CIRCLE, "arc": ARC, "sector": SECTOR,
+	"ellipticarc": ELLIPTICARC, "roundrect": ROUNDRECT, "ngon": NGON,
+	"starpoly": STARPOLY, "point": POINT, "midpoint": MIDPOINT,
+	"offset": OFFSET, "lerp": LERP, "apply": APPLY,
 }
@@ -14,16 +14,29 @@
 // along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
 package operation
 
+import "strconv"
+
+// ParseError is an error in a line of script. Pos is where the offending
+// token is, if known. An error in an expression also knows the offset of the
+// token in the expression.
 type ParseError struct {
 	line   string
 	token  string
 	reason string
+	Pos    Position
+	offset int
 }
 
 func NewParseError(line, token, reason string) *ParseError {
-	return &ParseError{line, token, reason}
+	return &ParseError{line, token, reason, Position{}, -1}
 }
 
 func (e *ParseError) Error() string {
-	return e.line + ": " + e.token + " -- " + e.reason
+	ret := e.line + ": " + e.token + " -- " + e.reason
+	if e.Pos.IsValid() {
+		ret = e.Pos.String() + ": " + ret
+	} else if e.offset >= 0 {
+		ret += " at column " + strconv.Itoa(e.offset+1)
+	}
+	return ret
 }
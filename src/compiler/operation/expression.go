@@ -0,0 +1,360 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package operation
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a node in the syntax tree of an arithmetic expression. The
+// operands are themselves values, so the leaves of the tree are values of type
+// FLOAT or VARIABLE. A unary operator like NEGATE only uses Right.
+type Expression struct {
+	Operator int16
+	Left     *Value
+	Right    *Value
+}
+
+func NewExpressionValue(op int16, left, right *Value) Value {
+	return Value{EXPRESSION, "", 0, nil, &Expression{op, left, right}, nil, nil}
+}
+
+// NewParameterValue makes a formal parameter of a figure, or an option. A
+// parameter without default value is simply a variable, and one with default
+// value is a PARAMETER, printed as name=value.
+func NewParameterValue(name string, def *Value) Value {
+	if def == nil || !ValidName(name) {
+		return NewVariableValue(name)
+	}
+	return Value{PARAMETER, name, 0, nil, nil, nil, def}
+}
+
+// ParseParameter parses a token of the form name or name=value into a
+// formal parameter, where the default value may be any expression.
+func ParseParameter(token string) (Value, error) {
+	i := strings.IndexRune(token, '=')
+	name := token
+	if i >= 0 {
+		name = token[:i]
+	}
+	if _, ok := GetCommand(name); ok || !ValidName(name) {
+		return NewVariableValue(""), NewParseError(token, name, "invalid parameter name")
+	}
+	if i < 0 {
+		return NewParameterValue(name, nil), nil
+	}
+	def, err := ParseExpression(token[i+1:])
+	if err != nil {
+		return def, err
+	}
+	return NewParameterValue(name, &def), nil
+}
+
+// Value.Parameter splits a formal parameter into its name and default value,
+// where the default value is nil if not given
+func (v *Value) Parameter() (string, *Value) {
+	if v.Type == PARAMETER {
+		return v.Name, v.Default
+	}
+	return v.Name, nil
+}
+
+func GetOperatorSymbol(op int16) string {
+	if int(op) >= len(operatorSymbols) {
+		return "?"
+	}
+	return operatorSymbols[op]
+}
+
+// Expression.ToString prints the expression fully parenthesized, so that the
+// structure of the tree is visible, e.g. x+y*2 becomes (x+(y*2))
+func (e *Expression) ToString() string {
+	if e.Left == nil {
+		return "(" + GetOperatorSymbol(e.Operator) + e.Right.ToString() + ")"
+	}
+	return "(" + e.Left.ToString() + GetOperatorSymbol(e.Operator) +
+		e.Right.ToString() + ")"
+}
+
+// exprParser is a recursive descent parser for expressions with the grammar
+//
+//	or         := and ("||" and)*
+//	and        := comparison ("&&" comparison)*
+//	comparison := sum (("<"|"<="|">"|">="|"=="|"!=") sum)?
+//	sum        := product (("+"|"-") product)*
+//	product    := unary (("*"|"/"|"%") unary)*
+//	unary      := ("-"|"+"|"!") unary | primary
+//	primary    := number | name | "(" or ")"
+type exprParser struct {
+	text string
+	pos  int
+}
+
+// ParseExpression parses a string into a value. A plain number or name gives
+// a value of type FLOAT or VARIABLE, anything else a value of type
+// EXPRESSION.
+//
+// Note that inside an expression "-" is always an operator, even though it is
+// allowed in names, so x-1 is a name but (x-1) is a subtraction.
+func ParseExpression(text string) (Value, error) {
+	parser := exprParser{text, 0}
+	value, err := parser.parseOr()
+	if err != nil {
+		return NewVariableValue(""), err
+	}
+	if token, start := parser.peek(); token != "" {
+		return NewVariableValue(""), parser.error(token, start, "unexpected token")
+	}
+	return value, nil
+}
+
+func (parser *exprParser) error(token string, start int, reason string) error {
+	if token == "" {
+		token = "$"
+	}
+	e := NewParseError(parser.text, token, reason)
+	e.offset = start
+	return e
+}
+
+// exprParser.peek returns the next token and its position without consuming
+// it. At the end of the text the token is empty.
+func (parser *exprParser) peek() (string, int) {
+	start := parser.pos
+	for start < len(parser.text) && parser.text[start] == ' ' {
+		start++
+	}
+	end := start
+	for end < len(parser.text) {
+		c := rune(parser.text[end])
+		if end == start {
+			end++
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '.' {
+				if end < len(parser.text) &&
+					twoCharOperators[parser.text[start:end+1]] {
+					end++
+				}
+				break
+			}
+		} else if isNumberStart(rune(parser.text[start])) {
+			if !unicode.IsDigit(c) && c != '.' {
+				break
+			}
+			end++
+		} else if unicode.IsLetter(c) || unicode.IsDigit(c) ||
+			c == '_' || c == '.' {
+			end++
+		} else {
+			break
+		}
+	}
+	return parser.text[start:end], start
+}
+
+func (parser *exprParser) next() (string, int) {
+	token, start := parser.peek()
+	parser.pos = start + len(token)
+	return token, start
+}
+
+func isNumberStart(c rune) bool {
+	return unicode.IsDigit(c) || c == '.'
+}
+
+var twoCharOperators = map[string]bool{
+	"<=": true, ">=": true, "==": true, "!=": true, "&&": true, "||": true,
+}
+
+var comparisonOperators = map[string]int16{
+	"<": LESS, "<=": LESS_EQUAL, ">": GREATER, ">=": GREATER_EQUAL,
+	"==": EQUAL, "!=": NOT_EQUAL,
+}
+
+func (parser *exprParser) parseOr() (Value, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return left, err
+	}
+	for {
+		if token, _ := parser.peek(); token != "||" {
+			return left, nil
+		}
+		parser.next()
+		right, err := parser.parseAnd()
+		if err != nil {
+			return right, err
+		}
+		leftCopy := left
+		left = NewExpressionValue(OR, &leftCopy, &right)
+	}
+}
+
+func (parser *exprParser) parseAnd() (Value, error) {
+	left, err := parser.parseComparison()
+	if err != nil {
+		return left, err
+	}
+	for {
+		if token, _ := parser.peek(); token != "&&" {
+			return left, nil
+		}
+		parser.next()
+		right, err := parser.parseComparison()
+		if err != nil {
+			return right, err
+		}
+		leftCopy := left
+		left = NewExpressionValue(AND, &leftCopy, &right)
+	}
+}
+
+// exprParser.parseComparison does not chain comparisons, as a<b<c would be
+// confusing, so it has to be written as a<b && b<c
+func (parser *exprParser) parseComparison() (Value, error) {
+	left, err := parser.parseSum()
+	if err != nil {
+		return left, err
+	}
+	token, _ := parser.peek()
+	op, ok := comparisonOperators[token]
+	if !ok {
+		return left, nil
+	}
+	parser.next()
+	right, err := parser.parseSum()
+	if err != nil {
+		return right, err
+	}
+	return NewExpressionValue(op, &left, &right), nil
+}
+
+func (parser *exprParser) parseSum() (Value, error) {
+	left, err := parser.parseProduct()
+	if err != nil {
+		return left, err
+	}
+	for {
+		token, _ := parser.peek()
+		var op int16
+		switch token {
+		case "+":
+			op = PLUS
+		case "-":
+			op = MINUS
+		default:
+			return left, nil
+		}
+		parser.next()
+		right, err := parser.parseProduct()
+		if err != nil {
+			return right, err
+		}
+		leftCopy := left
+		left = NewExpressionValue(op, &leftCopy, &right)
+	}
+}
+
+func (parser *exprParser) parseProduct() (Value, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return left, err
+	}
+	for {
+		token, _ := parser.peek()
+		var op int16
+		switch token {
+		case "*":
+			op = TIMES
+		case "/":
+			op = DIVIDE
+		case "%":
+			op = MODULO
+		default:
+			return left, nil
+		}
+		parser.next()
+		right, err := parser.parseUnary()
+		if err != nil {
+			return right, err
+		}
+		leftCopy := left
+		left = NewExpressionValue(op, &leftCopy, &right)
+	}
+}
+
+func (parser *exprParser) parseUnary() (Value, error) {
+	token, _ := parser.peek()
+	switch token {
+	case "+":
+		parser.next()
+		return parser.parseUnary()
+	case "-":
+		parser.next()
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return operand, err
+		}
+		// Fold negative literals, so that -5 is a number and not an expression
+		if operand.Type == FLOAT {
+			return NewNumberValue(-operand.Number), nil
+		}
+		return NewExpressionValue(NEGATE, nil, &operand), nil
+	case "!":
+		parser.next()
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return operand, err
+		}
+		return NewExpressionValue(NOT, nil, &operand), nil
+	}
+	return parser.parsePrimary()
+}
+
+func (parser *exprParser) parsePrimary() (Value, error) {
+	token, start := parser.next()
+	if token == "" {
+		return NewVariableValue(""),
+			parser.error(token, start, "unexpected end of expression")
+	}
+	c := rune(token[0])
+	if isNumberStart(c) {
+		if !isDecimal(token) {
+			return NewVariableValue(""),
+				parser.error(token, start, "invalid number or out of range")
+		}
+		number, _ := strconv.ParseFloat(token, 64)
+		return NewNumberValue(number), nil
+	}
+	if unicode.IsLetter(c) {
+		if _, ok := GetCommand(token); ok {
+			return NewVariableValue(""), parser.error(token, start, "is reserved")
+		}
+		return NewVariableValue(token), nil
+	}
+	if token == "(" {
+		value, err := parser.parseOr()
+		if err != nil {
+			return value, err
+		}
+		token, start = parser.next()
+		if token != ")" {
+			return NewVariableValue(""), parser.error(token, start, "expecting )")
+		}
+		return value, nil
+	}
+	return NewVariableValue(""), parser.error(token, start, "unexpected token")
+}
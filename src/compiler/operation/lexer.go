@@ -0,0 +1,244 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package operation
+
+import (
+	"io"
+	"strings"
+)
+
+// Token is a word of script, with the position of its first character
+type Token struct {
+	Text string
+	Pos  Position
+}
+
+// Lexer splits the text of a script into statements, each a list of tokens.
+//
+// A statement ends at the end of a line, unless the line ends with a
+// backslash, which continues it on the next line. Tokens are separated by any
+// whitespace other than newline, and by comments, either from // to the end of
+// the line, or between /* and */, possibly spanning lines. Inside parentheses
+// whitespace and comments don't separate tokens, so an expression in
+// parentheses is one token. A string in double quotes is kept as it is, see
+// Unquote, and may not span lines.
+type Lexer struct {
+	file   string
+	text   string
+	offset int
+	line   int
+	column int
+}
+
+func NewLexer(file string, text string) *Lexer {
+	return &Lexer{file, text, 0, 1, 1}
+}
+
+func (lexer *Lexer) position() Position {
+	return Position{lexer.file, lexer.line, lexer.column}
+}
+
+func (lexer *Lexer) error(pos Position, token string, reason string) error {
+	e := NewParseError(lexer.currentLine(), token, reason)
+	e.Pos = pos
+	return e
+}
+
+// Lexer.currentLine gives the line being read, for error messages
+func (lexer *Lexer) currentLine() string {
+	start := strings.LastIndexByte(lexer.text[:lexer.offset], '\n') + 1
+	end := strings.IndexByte(lexer.text[start:], '\n')
+	if end < 0 {
+		return lexer.text[start:]
+	}
+	return lexer.text[start : start+end]
+}
+
+// Lexer.peek gives the character n bytes ahead, or 0 at the end of the text
+func (lexer *Lexer) peek(n int) byte {
+	if lexer.offset+n >= len(lexer.text) {
+		return 0
+	}
+	return lexer.text[lexer.offset+n]
+}
+
+func (lexer *Lexer) advance(n int) {
+	for ; n > 0 && lexer.offset < len(lexer.text); n-- {
+		if lexer.text[lexer.offset] == '\n' {
+			lexer.line++
+			lexer.column = 0
+		}
+		lexer.offset++
+		lexer.column++
+	}
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// Lexer.skipSeparator skips a separator of tokens, i.e. a blank, a comment or
+// a backslash ending the line, and tells whether there was one. Newlines are
+// not separators, as they end statements.
+func (lexer *Lexer) skipSeparator() (bool, error) {
+	c := lexer.peek(0)
+	switch {
+	case isBlank(c):
+		lexer.advance(1)
+	case c == '/' && lexer.peek(1) == '/':
+		for lexer.peek(0) != '\n' && lexer.offset < len(lexer.text) {
+			lexer.advance(1)
+		}
+	case c == '/' && lexer.peek(1) == '*':
+		pos := lexer.position()
+		end := strings.Index(lexer.text[lexer.offset+2:], "*/")
+		if end < 0 {
+			err := lexer.error(pos, "/*", "comment not closed")
+			lexer.advance(len(lexer.text))
+			return true, err
+		}
+		lexer.advance(end + 4)
+	case c == '\\':
+		pos := lexer.position()
+		n := 1
+		for isBlank(lexer.peek(n)) {
+			n++
+		}
+		if lexer.peek(n) != '\n' && lexer.offset+n < len(lexer.text) {
+			return true, lexer.error(pos, "\\", "backslash not at end of line")
+		}
+		lexer.advance(n + 1)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Lexer.skipLine skips the rest of the line after an error, so that the next
+// statement can still be read
+func (lexer *Lexer) skipLine() {
+	for lexer.offset < len(lexer.text) && lexer.peek(0) != '\n' {
+		lexer.advance(1)
+	}
+}
+
+// Lexer.Next gives the tokens of the next statement which is not empty, or
+// io.EOF at the end of the text. After an error the rest of the line is
+// skipped, so the statements after it can still be read.
+func (lexer *Lexer) Next() ([]Token, error) {
+	tokens := []Token{}
+	for {
+		skipped, err := lexer.skipSeparator()
+		if err != nil {
+			lexer.skipLine()
+			return nil, err
+		}
+		if skipped {
+			continue
+		}
+		if lexer.offset >= len(lexer.text) {
+			if len(tokens) > 0 {
+				return tokens, nil
+			}
+			return nil, io.EOF
+		}
+		if lexer.peek(0) == '\n' {
+			lexer.advance(1)
+			if len(tokens) > 0 {
+				return tokens, nil
+			}
+			continue
+		}
+		token, err := lexer.token()
+		if err != nil {
+			lexer.skipLine()
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+// Lexer.token reads a token up to a separator or newline outside of
+// parentheses. Inside them, each separator is replaced by a space.
+func (lexer *Lexer) token() (Token, error) {
+	pos := lexer.position()
+	text := []byte{}
+	opens := []Position{}
+	for lexer.offset < len(lexer.text) && lexer.peek(0) != '\n' {
+		skipped, err := lexer.skipSeparator()
+		if err != nil {
+			return Token{string(text), pos}, err
+		}
+		if skipped && len(opens) == 0 {
+			break
+		}
+		if skipped {
+			text = append(text, ' ')
+			continue
+		}
+		c := lexer.peek(0)
+		switch c {
+		case '"':
+			str, err := lexer.quoted()
+			text = append(text, str...)
+			if err != nil {
+				return Token{string(text), pos}, err
+			}
+			continue
+		case '*':
+			if lexer.peek(1) == '/' {
+				return Token{string(text), pos},
+					lexer.error(lexer.position(), "*/", "comment not opened")
+			}
+		case '(':
+			opens = append(opens, lexer.position())
+		case ')':
+			if len(opens) == 0 {
+				return Token{string(text), pos},
+					lexer.error(lexer.position(), ")", "unmatched parenthesis")
+			}
+			opens = opens[:len(opens)-1]
+		}
+		text = append(text, c)
+		lexer.advance(1)
+	}
+	if len(opens) > 0 {
+		return Token{string(text), pos},
+			lexer.error(opens[len(opens)-1], "(", "parenthesis not closed")
+	}
+	return Token{string(text), pos}, nil
+}
+
+// Lexer.quoted reads a string in double quotes, where a backslash takes the
+// character after it along, so that \" does not end the string
+func (lexer *Lexer) quoted() (string, error) {
+	pos := lexer.position()
+	start := lexer.offset
+	lexer.advance(1)
+	for {
+		c := lexer.peek(0)
+		if c == '\n' || lexer.offset >= len(lexer.text) {
+			return lexer.text[start:lexer.offset],
+				lexer.error(pos, "\"", "string not closed")
+		}
+		if c == '\\' && (lexer.peek(1) == '"' || lexer.peek(1) == '\\') {
+			lexer.advance(1)
+		}
+		lexer.advance(1)
+		if c == '"' {
+			return lexer.text[start:lexer.offset], nil
+		}
+	}
+}
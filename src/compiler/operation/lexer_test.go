@@ -0,0 +1,97 @@
+// This file is part of autodraw.
+//
+// Autodraw is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Autodraw is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with autodraw.  If not, see <http://www.gnu.org/licenses/>.
+package operation
+
+import "testing"
+import "io"
+import "strings"
+
+// lexAll gives the statements of the text, with each token as text@line:column
+func lexAll(text string) ([]string, []string) {
+	lexer := NewLexer("", text)
+	statements, errors := []string{}, []string{}
+	for {
+		tokens, err := lexer.Next()
+		if err == io.EOF {
+			return statements, errors
+		}
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+		words := []string{}
+		for _, token := range tokens {
+			words = append(words, token.Text+"@"+token.Pos.String())
+		}
+		statements = append(statements, strings.Join(words, " "))
+	}
+}
+
+func TestLexer(t *testing.T) {
+	text := "line\t0 0  1 1 // a note\n" +
+		"\n" +
+		"  // only a comment\n" +
+		"rect 0 /* inline */ 0 1 1\n" +
+		"/* a comment\n spanning lines */ set x 1\n" +
+		"polygon 0 0 \\\n  1 0 \\  \n  1 1\n" +
+		"set y (x +\t1 /* one */ * 2)\n" +
+		"text 0 0 \"a // \\\" \\\\\" // note\n" +
+		"pop"
+	expects := []string{
+		"line@1:1 0@1:6 0@1:8 1@1:11 1@1:13",
+		"rect@4:1 0@4:6 0@4:21 1@4:23 1@4:25",
+		"set@6:20 x@6:24 1@6:26",
+		"polygon@7:1 0@7:9 0@7:11 1@8:3 0@8:5 1@9:3 1@9:5",
+		"set@10:1 y@10:5 (x + 1   * 2)@10:7",
+		"text@11:1 0@11:6 0@11:8 \"a // \\\" \\\\\"@11:10",
+		"pop@12:1",
+	}
+	statements, errors := lexAll(text)
+	if len(errors) > 0 {
+		t.Errorf("Unexpected errors: %v", errors)
+	}
+	if len(statements) != len(expects) {
+		t.Fatalf("Expect %d statements, got %v", len(expects), statements)
+	}
+	for i, expect := range expects {
+		if statements[i] != expect {
+			t.Errorf("Expect statement %s, got %s", expect, statements[i])
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := map[string]string{
+		"line 0 0 1 1 */":           "1:14: ",
+		"line 0 0 \\ 1 1":           "1:10: ",
+		"set x (1 + 2":              "1:7: ",
+		"set x ((1) + 2\n":          "1:7: ",
+		"set x 1)":                  "1:8: ",
+		"line 0 0 1 1\nrect /* 0 0": "2:6: ",
+		"text 0 0 \"a\n":            "1:10: ",
+	}
+	for test, expect := range tests {
+		_, errors := lexAll(test)
+		if len(errors) != 1 || !strings.HasPrefix(errors[0], expect) {
+			t.Errorf("Expect error at %s for [%s], got %v", expect, test, errors)
+		}
+	}
+	// The lines after an error are still read
+	statements, errors := lexAll("set x (1\nset y 2\n")
+	if len(errors) != 1 || len(statements) != 1 ||
+		statements[0] != "set@2:1 y@2:5 2@2:7" {
+		t.Errorf("Failed to read after error: %v %v", statements, errors)
+	}
+}
@@ -19,10 +19,41 @@ import (
 	"reflect"
 )
 
+// Position is the place of an operation or a token in a script file. Line and
+// Column count from 1, and are 0 if unknown.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+// Position.String gives the position as file:line:column, leaving out the
+// parts that are unknown
+func (pos Position) String() string {
+	ret := pos.File
+	if pos.IsValid() {
+		if ret != "" {
+			ret += ":"
+		}
+		ret += fmt.Sprintf("%d", pos.Line)
+		if pos.Column > 0 {
+			ret += fmt.Sprintf(":%d", pos.Column)
+		}
+	}
+	return ret
+}
+
+// Operation is a parsed line of script. Pos is where its command is, if it
+// comes from a file.
 type Operation struct {
 	Command int16
 	Name    string
 	Args    []Value
+	Pos     Position
 }
 
 func NewOperation(op int16) Operation {
@@ -54,6 +85,10 @@ func (op *Operation) ToString() string {
 	return ret
 }
 
+// Operation.Equal tells whether two operations are the same, wherever they
+// are in the script
 func (op *Operation) Equal(op2 Operation) bool {
-	return reflect.DeepEqual(*op, op2)
+	op1 := *op
+	op1.Pos, op2.Pos = Position{}, Position{}
+	return reflect.DeepEqual(op1, op2)
 }
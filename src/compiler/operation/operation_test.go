@@ -97,6 +97,33 @@ func TestNewOperation(t *testing.T) {
 		len(operation.Args) != 0 {
 		t.Errorf("NewDrawOperation(plane) failed, got %s", operation.ToString())
 	}
+	operation = newDrawOperation("box", NewNumberValue(10), NewVariableValue("T"))
+	if operation.Command != DRAW || operation.Name != "box" ||
+		!reflect.DeepEqual(operation.Args,
+			[]Value{NewNumberValue(10), NewVariableValue("T")}) {
+		t.Errorf("NewDrawOperation(box,10,T) failed, got %s", operation.ToString())
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tokens := []string{
+		`"label"`,
+		`"$\alpha$ \\ \"b\""`,
+		`"a\\"`,
+		`"\\\"b"`,
+		`"\a\b"`,
+	}
+	for _, token := range tokens {
+		text, ok := Unquote(token)
+		if !ok {
+			t.Errorf("Failed to unquote [%s]", token)
+			continue
+		}
+		if result, ok := Unquote(Quote(text)); !ok || result != text {
+			t.Errorf("Expect [%s] back from %s, got [%s]", text, Quote(text),
+				result)
+		}
+	}
 }
 
 func TestToString(t *testing.T) {
@@ -209,6 +236,15 @@ func TestToString(t *testing.T) {
 		t.Errorf("OperationToString(%s operation) failed! Expect %s, got %s",
 			"import", expect, operationStr)
 	}
+	ten := NewNumberValue(10)
+	operation = newBeginOperation("box",
+		NewParameterValue("w", nil), NewParameterValue("h", &ten))
+	operationStr = operation.ToString()
+	expect = fmt.Sprintf("begin box [w,h=10]")
+	if operationStr != expect {
+		t.Errorf("OperationToString(%s operation) failed! Expect %s, got %s",
+			"begin", expect, operationStr)
+	}
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -285,12 +321,16 @@ func newPushOperation(name string) Operation {
 	return newOperationTypeState(PUSH, name)
 }
 
-func newDrawOperation(name string) Operation {
-	return newOperationTypeState(DRAW, name)
+func newDrawOperation(name string, args ...Value) Operation {
+	return newOperationTypeInvoke(DRAW, name, args...)
 }
 
-func newImportOperation(path string) Operation {
-	return newOperationTypeState(IMPORT, path)
+func newBeginOperation(name string, params ...Value) Operation {
+	return newOperationTypeInvoke(BEGIN, name, params...)
+}
+
+func newImportOperation(path string, alias ...Value) Operation {
+	return newOperationTypeInvoke(IMPORT, path, alias...)
 }
 
 func newUseOperation(name string) Operation {
@@ -324,6 +364,16 @@ func newOperationTypeSingle(op int16) Operation {
 	return operation
 }
 
+func newOperationTypeInvoke(op int16, name string, args ...Value) Operation {
+	if !ValidName(name) {
+		return NewOperation(UNDEFINED)
+	}
+	operation := NewOperation(op)
+	operation.Name = name
+	operation.Args = append([]Value{}, args...)
+	return operation
+}
+
 func newOperationTypeState(op int16, name string) Operation {
 	if !ValidName(name) {
 		return NewOperation(UNDEFINED)
@@ -15,17 +15,22 @@
 package operation
 
 import (
+	"io"
 	"strings"
 	"strconv"
 )
 
 type LineParser struct {
 	line string
+	pos  Position
+	at   Position
 
 	expectName   bool
 	expectArgs   bool
 	expectArgNum int
 	undetermined   bool
+	keyword bool
+	segment int
 
 	command int16
 	name    string
@@ -46,19 +51,50 @@ func (parser *LineParser) Initialize() {
 	parser.expectArgs = false
 	parser.expectArgNum = 0
 	parser.undetermined = false
+	parser.keyword = false
+	parser.segment = 0
 	parser.command = UNDEFINED
 	parser.name = ""
 	parser.args = []Value{}
 	parser.state = NEED_COMMAND
 }
 
+// LineParser.SetPosition tells the parser the file and the line number of
+// the lines it parses next, which are recorded in the operations and errors
+func (parser *LineParser) SetPosition(file string, line int) {
+	parser.pos = Position{file, line, 0}
+}
+
 func (parser *LineParser) Error(token string, reason string) *ParseError {
 	parser.state = ERROR
-	return NewParseError(parser.line, token, reason)
+	return parser.newError(token, reason)
+}
+
+// LineParser.newError makes an error at the token being parsed
+func (parser *LineParser) newError(token string, reason string) *ParseError {
+	e := NewParseError(parser.line, token, reason)
+	if parser.at.IsValid() {
+		e.Pos = parser.at
+	}
+	return e
 }
 
-func (parser *LineParser) appendNumberArg(arg int16) {
-	parser.args = append(parser.args, NewNumberValue(int16(arg)))
+// LineParser.errorIn reports an error in an expression or parameter, at the
+// offending token inside it if known
+func (parser *LineParser) errorIn(err error) *ParseError {
+	e := err.(*ParseError)
+	if e.offset >= 0 {
+		parser.at.Column += e.offset
+	}
+	ret := parser.Error(e.token, e.reason)
+	if !ret.Pos.IsValid() {
+		ret.offset = e.offset
+	}
+	return ret
+}
+
+func (parser *LineParser) appendNumberArg(arg float64) {
+	parser.args = append(parser.args, NewNumberValue(arg))
 }
 
 func (parser *LineParser) appendVariableArg(token string) {
@@ -69,6 +105,19 @@ func (parser *LineParser) getArgNum() int {
 	return len(parser.args)
 }
 
+// LineParser.checkArgNum finishes the operation when enough arguments are
+// collected, and complains if there are too many.
+func (parser *LineParser) checkArgNum(token string) error {
+	if parser.getArgNum() == parser.expectArgNum {
+		parser.state = FINISH
+	} else if parser.getArgNum() > parser.expectArgNum {
+		if !parser.undetermined {
+			return parser.Error(token, "too many arguments")
+		}
+	}
+	return nil
+}
+
 func (parser *LineParser) Update(token string) error {
 	token = strings.Trim(token, " ")
 	if token == "" {
@@ -76,7 +125,7 @@ func (parser *LineParser) Update(token string) error {
 	}
 	tokenType := tokenIdentify(token)
 	if tokenType == INVALID {
-		return NewParseError(parser.line, token, "invalid token")
+		return parser.newError(token, "invalid token")
 	}
 	switch parser.state {
 	case NEED_COMMAND:
@@ -99,11 +148,11 @@ func (parser *LineParser) Update(token string) error {
 	case NEED_NAME:
 		if tokenType == COMMAND {
 			return parser.Error(token, "is reserved")
-		} else if tokenType == NUMBER {
+		} else if tokenType == NUMBER || tokenType == FORMULA {
 			return parser.Error(token, "expecting name")
 		} else if tokenType == NAME {
 			parser.name = token
-			if parser.expectArgs {
+			if parser.expectArgs && (parser.expectArgNum > 0 || parser.undetermined) {
 				parser.state = NEED_VALUE
 			} else {
 				parser.state = FINISH
@@ -112,27 +161,63 @@ func (parser *LineParser) Update(token string) error {
 			return parser.Error(token, "unknown token")
 		}
 	case NEED_VALUE:
-		if tokenType == COMMAND {
+		if parser.command == PATH && parser.segment == 0 {
+			return parser.updateSegment(token)
+		} else if tokenType == COMMAND {
 			return parser.Error(token, "is reserved")
-		} else if tokenType == NUMBER {
-			number, _ := strconv.ParseInt(token, 10, 16)
-			parser.appendNumberArg(int16(number))
-			if parser.getArgNum() == parser.expectArgNum {
-				parser.state = FINISH
-			} else if parser.getArgNum() > parser.expectArgNum {
-				if !parser.undetermined {
-					return parser.Error(token, "too many arguments")
+		} else if parser.command == BEGIN {
+			value, err := ParseParameter(token)
+			if err != nil {
+				return parser.errorIn(err)
+			}
+			parser.args = append(parser.args, value)
+			return parser.checkArgNum(token)
+		} else if parser.command == IMPORT {
+			// The only argument of import is the alias after the keyword as, which
+			// is not kept in the operation
+			if !parser.keyword {
+				if token != "as" {
+					return parser.Error(token, "expecting as")
 				}
+				parser.keyword = true
+				return nil
+			}
+			if tokenType != NAME {
+				return parser.Error(token, "expecting name")
+			}
+			parser.appendVariableArg(token)
+			return parser.checkArgNum(token)
+		} else if token == "->" &&
+			(parser.command == HOMOGRAPHY || parser.command == MAP) {
+			// The optional arrow separates the points from the points they are
+			// mapped to, so it must be in the middle
+			if parser.getArgNum() != parser.expectArgNum/2 {
+				return parser.Error(token, "expecting -> in the middle")
 			}
+			return nil
+		} else if parser.command == TEXT && parser.getArgNum() >= 2 {
+			return parser.updateText(token, tokenType)
+		} else if parser.command == STYLE {
+			return parser.updateOption(token)
+		} else if tokenType == QUOTED {
+			return parser.Error(token, "unexpected string")
+		} else if tokenType == NUMBER {
+			number, _ := strconv.ParseFloat(token, 64)
+			parser.appendNumberArg(number)
+			parser.countSegment()
+			return parser.checkArgNum(token)
 		} else if tokenType == NAME {
 			parser.appendVariableArg(token)
-			if parser.getArgNum() == parser.expectArgNum {
-				parser.state = FINISH
-			} else if parser.getArgNum() > parser.expectArgNum {
-				if !parser.undetermined {
-					return parser.Error(token, "too many arguments")
-				}
+			parser.countSegment()
+			return parser.checkArgNum(token)
+		} else if tokenType == FORMULA {
+			value, err := ParseExpression(token)
+			if err != nil {
+				return parser.errorIn(err)
 			}
+			parser.args = append(parser.args, value)
+			parser.countSegment()
+			return parser.checkArgNum(token)
 		} else {
 			return parser.Error(token, "unknown token")
 		}
@@ -144,11 +229,98 @@ func (parser *LineParser) Update(token string) error {
 	return nil
 }
 
+// LineParser.countSegment counts a coordinate of the current segment of PATH,
+// the other commands have no segments
+func (parser *LineParser) countSegment() {
+	if parser.command == PATH {
+		parser.segment--
+	}
+}
+
+// LineParser.updateSegment takes the keyword starting a segment of PATH, which
+// is kept as a variable followed by the coordinates of the segment. The first
+// one must be move.
+func (parser *LineParser) updateSegment(token string) error {
+	n, ok := PathSegmentArgs(token)
+	if !ok {
+		return parser.Error(token, "expecting segment")
+	}
+	if parser.getArgNum() == 0 && token != "move" {
+		return parser.Error(token, "expecting move")
+	}
+	parser.appendVariableArg(token)
+	parser.segment = n
+	return nil
+}
+
+// LineParser.updateText takes the arguments of TEXT after the position, i.e.
+// the string and then options like anchor=north, which are kept as parameters
+// with their values
+func (parser *LineParser) updateText(token string, tokenType int16) error {
+	if parser.getArgNum() == 2 {
+		if tokenType != QUOTED {
+			return parser.Error(token, "expecting string")
+		}
+		text, _ := Unquote(token)
+		parser.args = append(parser.args, NewStringValue(text))
+		return nil
+	}
+	return parser.updateOption(token)
+}
+
+// LineParser.updateOption takes an option like width=2, i.e. a parameter
+// with its value, as the options of TEXT and STYLE are. A value can be a
+// name like end even if it is reserved, as names of options are not commands.
+func (parser *LineParser) updateOption(token string) error {
+	i := strings.IndexRune(token, '=')
+	if i < 0 {
+		return parser.Error(token, "expecting option")
+	}
+	name, word := token[:i], token[i+1:]
+	if _, reserved := GetCommand(word); !reserved || !ValidName(word) {
+		value, err := ParseParameter(token)
+		if err != nil {
+			return parser.errorIn(err)
+		}
+		parser.args = append(parser.args, value)
+		return nil
+	}
+	if _, ok := GetCommand(name); ok || !ValidName(name) {
+		return parser.errorIn(
+			NewParseError(token, name, "invalid parameter name"))
+	}
+	def := NewVariableValue(word)
+	parser.args = append(parser.args, NewParameterValue(name, &def))
+	return nil
+}
+
+// LineParser.mayHavePoints tells whether a drawing with a fixed number of
+// coordinates may have all of them, as a variable may be a point standing for
+// two coordinates, which is only known when it is run
+func (parser *LineParser) mayHavePoints() bool {
+	commandType := GetType(parser.command)
+	if commandType != DRAW_FIXED && commandType != DRAW_SHAPE {
+		return false
+	}
+	for _, arg := range parser.args {
+		if arg.Type == VARIABLE {
+			return true
+		}
+	}
+	return false
+}
+
 func (parser *LineParser) Digest() (Operation, error) {
-	if !parser.undetermined && parser.state != FINISH {
+	if !parser.undetermined && parser.state != FINISH &&
+		!(parser.state == NEED_VALUE && parser.mayHavePoints()) ||
+		parser.state == NEED_NAME || parser.keyword && parser.getArgNum() == 0 ||
+		parser.command == TEXT && parser.getArgNum() < 3 ||
+		parser.command == STYLE && parser.getArgNum() == 0 ||
+		parser.command == PATH && (parser.segment > 0 || parser.getArgNum() == 0) {
 		return NewOperation(UNDEFINED), parser.Error("$", "not finished")
 	} else {
 		op := NewOperation(parser.command)
+		op.Pos = parser.pos
 		if parser.expectName {
 			op.Name = parser.name
 		}
@@ -160,20 +332,43 @@ func (parser *LineParser) Digest() (Operation, error) {
 	}
 }
 
+// LineParser.ParseLine parses a line into an operation. An error in a former
+// line does not affect it.
 func (parser *LineParser) ParseLine(line string) (Operation, error) {
-	parser.line = line
-	line = strings.Trim(line, " ")
-	tokens := strings.Split(line, " ")
+	lexer := NewLexer(parser.pos.File, line)
+	lexer.line = parser.pos.Line
+	tokens, err := lexer.Next()
+	if err == io.EOF {
+		return NewOperation(UNDEFINED), NewParseError("", "", "empty line")
+	}
+	if err != nil {
+		return NewOperation(UNDEFINED), err
+	}
+	return parser.ParseTokens(tokens)
+}
 
+// LineParser.ParseTokens parses the tokens of a statement, as given by a
+// Lexer, into an operation at the position of the first token
+func (parser *LineParser) ParseTokens(tokens []Token) (Operation, error) {
+	parser.Initialize()
 	if len(tokens) == 0 {
 		return NewOperation(UNDEFINED), NewParseError("", "", "empty line")
 	}
+	texts := make([]string, len(tokens))
+	for i, token := range tokens {
+		texts[i] = token.Text
+	}
+	parser.line = strings.Join(texts, " ")
+	parser.pos = tokens[0].Pos
 
 	for _, token := range tokens {
-		err := parser.Update(token)
+		parser.at = token.Pos
+		err := parser.Update(token.Text)
 		if err != nil {
 			return NewOperation(UNDEFINED), err
 		}
 	}
+	// A missing argument is reported right after the last token
+	parser.at.Column += len(tokens[len(tokens)-1].Text)
 	return parser.Digest()
 }
@@ -15,6 +15,7 @@
 package operation
 
 import "testing"
+import "strings"
 
 func BenchmarkParseLine(b *testing.B) {
 	tests := []string{
@@ -99,3 +100,471 @@ func TestParseLine(t *testing.T) {
 		}
 	}
 }
+
+func TestParseExpression(t *testing.T) {
+	tests := []string{
+		"x+w",
+		"r*2",
+		"1+2*3",
+		"(1+2)*3",
+		"-x",
+		"-5",
+		"a-b",
+		"(a-b)",
+		"(x + w) / 2 % 3",
+		"--x",
+		"a.b_c*-(y)",
+		"a<b&&c",
+		"!x||y>=2*z",
+		"a==b+1 || a!=c && (b<=c)",
+		"0.5*x-.25",
+		"-1.5",
+	}
+	expects := []string{
+		"(x+w)",
+		"(r*2)",
+		"(1+(2*3))",
+		"((1+2)*3)",
+		"(-x)",
+		"-5",
+		"(a-b)",
+		"(a-b)",
+		"(((x+w)/2)%3)",
+		"(-(-x))",
+		"(a.b_c*(-y))",
+		"((a<b)&&c)",
+		"((!x)||(y>=(2*z)))",
+		"((a==(b+1))||((a!=c)&&(b<=c)))",
+		"((0.5*x)-0.25)",
+		"-1.5",
+	}
+	for i, test := range tests {
+		value, err := ParseExpression(test)
+		if err != nil {
+			t.Errorf("Failed to parse expression %s: %s", test, err.Error())
+			continue
+		}
+		if value.ToString() != expects[i] {
+			t.Errorf("Parse expression %s, expect %s, got %s",
+				test, expects[i], value.ToString())
+		}
+	}
+	invalids := []string{
+		"",
+		"x+",
+		"(x+1",
+		"x+1)",
+		"x y",
+		"2x",
+		"line*2",
+		"1.2.3",
+		"x$2",
+		"a<b<c",
+		"a=b",
+		"a&b",
+	}
+	for _, test := range invalids {
+		_, err := ParseExpression(test)
+		if err == nil {
+			t.Errorf("Expression %s should be invalid", test)
+		}
+	}
+}
+
+func TestParseLineExpression(t *testing.T) {
+	x, w := NewVariableValue("x"), NewVariableValue("w")
+	y, h := NewVariableValue("y"), NewVariableValue("h")
+	r, two := NewVariableValue("r"), NewNumberValue(2)
+	onehalf := NewNumberValue(1.5)
+	tests := []string{
+		"line x y x+w y+h",
+		"set r2 r*2",
+		"line x y (x + w) (y + h)",
+		"line x y x+ y",
+		"line x y (x + w y",
+		"rotate T 1.2.3",
+		"rotate T 22.5",
+		"line 0.5 -1.25 .5 (x*1.5)",
+	}
+	expects := []Operation{
+		newLineOperation(x, y,
+			NewExpressionValue(PLUS, &x, &w), NewExpressionValue(PLUS, &y, &h)),
+		newSetOperation("r2", NewExpressionValue(TIMES, &r, &two)),
+		newLineOperation(x, y,
+			NewExpressionValue(PLUS, &x, &w), NewExpressionValue(PLUS, &y, &h)),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		newRotateOperation("T", NewNumberValue(22.5)),
+		newLineOperation(NewNumberValue(0.5), NewNumberValue(-1.25),
+			NewNumberValue(0.5), NewExpressionValue(TIMES, &x, &onehalf)),
+	}
+	parser := NewLineParser()
+	for i, test := range tests {
+		result, err := parser.ParseLine(test)
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+		parser.Initialize()
+	}
+}
+
+func TestParseLineParameters(t *testing.T) {
+	w, ten := NewVariableValue("w"), NewNumberValue(10)
+	two := NewNumberValue(2)
+	double := NewExpressionValue(TIMES, &w, &two)
+	tests := []string{
+		"begin box",
+		"begin box w h",
+		"begin box w h=10 d=w*2",
+		"draw box 10 T",
+		"draw box (w + 10)",
+		"begin box w h=",
+		"begin box 10",
+		"begin box line",
+		"begin",
+		"draw",
+	}
+	expects := []Operation{
+		newBeginOperation("box"),
+		newBeginOperation("box",
+			NewParameterValue("w", nil), NewParameterValue("h", nil)),
+		newBeginOperation("box", NewParameterValue("w", nil),
+			NewParameterValue("h", &ten), NewParameterValue("d", &double)),
+		newDrawOperation("box", ten, NewVariableValue("T")),
+		newDrawOperation("box", NewExpressionValue(PLUS, &w, &ten)),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+	}
+	for i, test := range tests {
+		parser := NewLineParser()
+		result, err := parser.ParseLine(test)
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+	}
+
+	// The default value is kept apart from the expressions
+	param, err := ParseParameter("d=w*2")
+	name, def := param.Parameter()
+	if err != nil || param.Type != PARAMETER || param.Expr != nil ||
+		name != "d" || def == nil || def.ToString() != double.ToString() ||
+		param.ToString() != "d=(w*2)" {
+		t.Errorf("Wrong parameter %s: %v", param.ToString(), err)
+	}
+}
+
+func TestParseLineImport(t *testing.T) {
+	tests := []string{
+		"import lib",
+		"import lib as l",
+		"import lib.shapes as s",
+		"import lib l",
+		"import lib as",
+		"import lib as 10",
+		"import lib as l m",
+	}
+	expects := []Operation{
+		newImportOperation("lib"),
+		newImportOperation("lib", NewVariableValue("l")),
+		newImportOperation("lib.shapes", NewVariableValue("s")),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+	}
+	for i, test := range tests {
+		parser := NewLineParser()
+		result, err := parser.ParseLine(test)
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+	}
+}
+
+func TestParseLineTransforms(t *testing.T) {
+	tests := []string{
+		"flipx T",
+		"flipy T",
+		"flipxy T",
+		"scalex T 200",
+		"scaley T -50",
+		"scalexy T 200 50",
+		"combine T T1 T2",
+		"invert T S",
+		"power T S -3",
+		"shear T 50 0",
+		"rotateabout T 90 10 20",
+		"mirror T 0 0 10 10",
+		"homography T 0 0 1 0 1 1 0 1 -> 0 0 2 0 2 2 0 2",
+		"map T 0 0 1 0 0 1 2 3 4 3 3 5",
+		"map T 0 0 1 0 0 1 -> 2 3 4 3 3 5",
+		"map T 0 0 1 0 -> 0 1 2 3 4 3 3 5",
+		"flipx T 1",
+		"scalex T",
+		"combine T T1",
+		"power T S",
+		"mirror T 0 0 10",
+	}
+	expects := []Operation{
+		newOperationTypeAssign(FLIPX, "T"),
+		newOperationTypeAssign(FLIPY, "T"),
+		newOperationTypeAssign(FLIPXY, "T"),
+		newOperationTypeAssign(SCALEX, "T", NewNumberValue(200)),
+		newOperationTypeAssign(SCALEY, "T", NewNumberValue(-50)),
+		newOperationTypeAssign(SCALEXY, "T", NewNumberValues(200, 50)...),
+		newOperationTypeAssign(COMBINE, "T",
+			NewVariableValue("T1"), NewVariableValue("T2")),
+		newOperationTypeAssign(INVERT, "T", NewVariableValue("S")),
+		newOperationTypeAssign(POWER, "T",
+			NewVariableValue("S"), NewNumberValue(-3)),
+		newOperationTypeAssign(SHEAR, "T", NewNumberValues(50, 0)...),
+		newOperationTypeAssign(ROTATEABOUT, "T", NewNumberValues(90, 10, 20)...),
+		newOperationTypeAssign(MIRROR, "T", NewNumberValues(0, 0, 10, 10)...),
+		newOperationTypeAssign(HOMOGRAPHY, "T",
+			NewNumberValues(0, 0, 1, 0, 1, 1, 0, 1, 0, 0, 2, 0, 2, 2, 0, 2)...),
+		newOperationTypeAssign(MAP, "T",
+			NewNumberValues(0, 0, 1, 0, 0, 1, 2, 3, 4, 3, 3, 5)...),
+		newOperationTypeAssign(MAP, "T",
+			NewNumberValues(0, 0, 1, 0, 0, 1, 2, 3, 4, 3, 3, 5)...),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+	}
+	for i, test := range tests {
+		parser := NewLineParser()
+		result, err := parser.ParseLine(test)
+		if len(result.Args) == 0 {
+			result.Args = nil
+		}
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+	}
+}
+
+func TestParseLinePosition(t *testing.T) {
+	parser := NewLineParser()
+	parser.SetPosition("main.adr", 3)
+	result, err := parser.ParseLine("  line 0 0 1 1")
+	if err != nil || result.Pos != (Position{"main.adr", 3, 3}) {
+		t.Errorf("Wrong position of operation: %v %v", result.Pos, err)
+	}
+	tests := map[string]string{
+		"rect 0 0 1 1 q":  "main.adr:3:14: ",
+		"  line 0 0 1":    "main.adr:3:13: ",
+		"line 0 (1+) 1 1": "main.adr:3:11: ",
+		"foo 1":           "main.adr:3:1: ",
+	}
+	for test, expect := range tests {
+		_, err := parser.ParseLine(test)
+		if err == nil || !strings.HasPrefix(err.Error(), expect) {
+			t.Errorf("Expect error at %s for [%s], got %v", expect, test, err)
+		}
+	}
+	// An error does not spoil the lines after
+	if result, err := parser.ParseLine("pop"); err != nil ||
+		result.Command != POP {
+		t.Errorf("Failed to parse after error: %v", err)
+	}
+}
+
+func TestParseLineText(t *testing.T) {
+	tests := []string{
+		`text 10 20 "label"`,
+		`text x (y+1) "$\alpha$ \\ \"b\"" anchor=south align=left`,
+		`text 0 0 "a // b /* c */"`,
+		`text 0 0`,
+		`text 0 0 label`,
+		`text 0 "label" 0`,
+		`text 0 0 "label" south`,
+		`line 0 0 "1" 1`,
+	}
+	expr, _ := ParseExpression("y+1")
+	anchor, _ := ParseParameter("anchor=south")
+	align, _ := ParseParameter("align=left")
+	expects := []Operation{
+		newOperationTypeText(NewNumberValue(10), NewNumberValue(20),
+			NewStringValue("label")),
+		newOperationTypeText(NewVariableValue("x"), expr,
+			NewStringValue(`$\alpha$ \\ "b"`), anchor, align),
+		newOperationTypeText(NewNumberValue(0), NewNumberValue(0),
+			NewStringValue("a // b /* c */")),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+	}
+	for i, test := range tests {
+		parser := NewLineParser()
+		result, err := parser.ParseLine(test)
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+	}
+}
+
+func newOperationTypeText(args ...Value) Operation {
+	op := NewOperation(TEXT)
+	op.Args = args
+	return op
+}
+
+func TestParseLineStyle(t *testing.T) {
+	tests := []string{
+		"style stroke=red fill=none",
+		"style width=(w*2) dash=dashed",
+		"style arrow=end",
+		"gsave",
+		"grestore",
+		"style",
+		"style red",
+		"style line=1",
+		"style line=end",
+		"gsave 1",
+	}
+	stroke, _ := ParseParameter("stroke=red")
+	fill, _ := ParseParameter("fill=none")
+	width, _ := ParseParameter("width=(w*2)")
+	dash, _ := ParseParameter("dash=dashed")
+	style := NewOperation(STYLE)
+	style.Args = []Value{stroke, fill}
+	style2 := NewOperation(STYLE)
+	style2.Args = []Value{width, dash}
+	end := NewVariableValue("end")
+	style3 := NewOperation(STYLE)
+	style3.Args = []Value{NewParameterValue("arrow", &end)}
+	expects := []Operation{
+		style,
+		style2,
+		style3,
+		NewOperation(GSAVE),
+		NewOperation(GRESTORE),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+	}
+	for i, test := range tests {
+		parser := NewLineParser()
+		result, err := parser.ParseLine(test)
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+	}
+}
+
+func TestParseLinePath(t *testing.T) {
+	tests := []string{
+		"path move 0 0 line 10 0 quad 15 5 10 10 cubic 5 15 0 15 0 10 close",
+		"path move x (y+1) line move 0",
+		"path",
+		"path line 0 0",
+		"path move 0 0 line 1",
+		"path move 0 0 arc 1 1",
+		"path move 0 0 1 1",
+	}
+	expr, _ := ParseExpression("y+1")
+	path := NewOperation(PATH)
+	path.Args = []Value{NewVariableValue("move"),
+		NewNumberValue(0), NewNumberValue(0),
+		NewVariableValue("line"), NewNumberValue(10), NewNumberValue(0),
+		NewVariableValue("quad"), NewNumberValue(15), NewNumberValue(5),
+		NewNumberValue(10), NewNumberValue(10),
+		NewVariableValue("cubic"), NewNumberValue(5), NewNumberValue(15),
+		NewNumberValue(0), NewNumberValue(15), NewNumberValue(0),
+		NewNumberValue(10), NewVariableValue("close")}
+	// A coordinate may be a variable with the name of a segment
+	path2 := NewOperation(PATH)
+	path2.Args = []Value{NewVariableValue("move"), NewVariableValue("x"), expr,
+		NewVariableValue("line"), NewVariableValue("move"), NewNumberValue(0)}
+	expects := []Operation{
+		path,
+		path2,
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+	}
+	for i, test := range tests {
+		parser := NewLineParser()
+		result, err := parser.ParseLine(test)
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+	}
+}
+
+func TestParseLinePoints(t *testing.T) {
+	tests := []string{
+		"point P 10 (x+1)",
+		"midpoint M A B",
+		"offset Q P 5 -5",
+		"lerp R A B 0.25",
+		"apply Q T P",
+		"line P Q",
+		"rect P 10 10",
+		"circle C 5",
+		"line 0 0 1",
+		"circle 0 5",
+		"point P 10",
+		"midpoint M A",
+		"lerp R A B 0.5 1",
+	}
+	expr, _ := ParseExpression("x+1")
+	expects := []Operation{
+		newOperationTypeAssign(POINT, "P", NewNumberValue(10), expr),
+		newOperationTypeAssign(MIDPOINT, "M",
+			NewVariableValue("A"), NewVariableValue("B")),
+		newOperationTypeAssign(OFFSET, "Q",
+			NewVariableValue("P"), NewNumberValue(5), NewNumberValue(-5)),
+		newOperationTypeAssign(LERP, "R",
+			NewVariableValue("A"), NewVariableValue("B"), NewNumberValue(0.25)),
+		newOperationTypeAssign(APPLY, "Q",
+			NewVariableValue("T"), NewVariableValue("P")),
+		// A variable may be a point, so the coordinates are counted when run
+		newOperationTypeDrawFixed(LINE,
+			NewVariableValue("P"), NewVariableValue("Q")),
+		newOperationTypeDrawFixed(RECT,
+			NewVariableValue("P"), NewNumberValue(10), NewNumberValue(10)),
+		newOperationTypeDrawFixed(CIRCLE,
+			NewVariableValue("C"), NewNumberValue(5)),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+		NewOperation(UNDEFINED),
+	}
+	for i, test := range tests {
+		parser := NewLineParser()
+		result, err := parser.ParseLine(test)
+		if !expects[i].Equal(result) ||
+			(expects[i].Command == UNDEFINED) != (err != nil) {
+			t.Errorf("Parser failed for [%s], expect (%s), got (%s): %v\n",
+				test, expects[i].ToString(), result.ToString(), err)
+		}
+	}
+}
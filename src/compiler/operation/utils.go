@@ -17,6 +17,7 @@ package operation
 import (
 	"unicode"
 	"strconv"
+	"strings"
 )
 
 func ValidName(name string) bool {
@@ -44,9 +45,86 @@ func tokenIdentify(token string) int16 {
 	if ValidName(token) {
 		return NAME
 	}
-	_, err := strconv.ParseInt(token, 10, 16)
-	if err != nil {
+	if _, ok := Unquote(token); ok {
+		return QUOTED
+	}
+	if !isDecimal(token) {
+		if isFormula(token) {
+			return FORMULA
+		}
 		return INVALID
 	}
 	return NUMBER
 }
+
+// isDecimal tells whether the token is a plain decimal literal like -12 or
+// 0.5, with an optional sign, and in the range of float64. Forms like 1e5
+// that strconv also accepts are left out.
+func isDecimal(token string) bool {
+	if strings.HasPrefix(token, "-") || strings.HasPrefix(token, "+") {
+		token = token[1:]
+	}
+	digits, dots := 0, 0
+	for _, c := range token {
+		if c == '.' {
+			dots++
+		} else if unicode.IsDigit(c) {
+			digits++
+		} else {
+			return false
+		}
+	}
+	if digits == 0 || dots > 1 {
+		return false
+	}
+	_, err := strconv.ParseFloat(token, 64)
+	return err == nil
+}
+
+// isFormula tells whether the token consists only of characters that may
+// appear in an expression. Whether it is a valid expression is decided later
+// by ParseExpression.
+func isFormula(token string) bool {
+	for _, c := range token {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) &&
+			!strings.ContainsRune(" _.+-*/%()=<>!&|", c) {
+			return false
+		}
+	}
+	return len(token) > 0
+}
+
+// Unquote gives the text of a string token in double quotes. Inside, \" stands
+// for a quote, and the other backslashes are kept as they are, so LaTeX like
+// "$\alpha$ \\ $\beta$" needs no escaping. A backslash followed by another one
+// is kept with it, so "a\\" ends with both of them.
+func Unquote(token string) (string, bool) {
+	if len(token) < 2 || token[0] != '"' {
+		return "", false
+	}
+	text := []byte{}
+	for i := 1; i < len(token); i++ {
+		c := token[i]
+		if c == '"' {
+			return string(text), i == len(token)-1
+		}
+		if c == '\\' && i+1 < len(token) &&
+			(token[i+1] == '"' || token[i+1] == '\\') {
+			i++
+			if token[i] == '\\' {
+				text = append(text, c)
+			}
+			c = token[i]
+		}
+		text = append(text, c)
+	}
+	return "", false
+}
+
+// Quote puts the text in double quotes, so that Unquote gives back any text
+// it has given. As a backslash is only escaped before another one, a text
+// with an odd number of backslashes before a quote or at its end, like a\ or
+// a\"b, cannot be written in a script and is not given back.
+func Quote(text string) string {
+	return "\"" + strings.ReplaceAll(text, "\"", "\\\"") + "\""
+}
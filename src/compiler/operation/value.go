@@ -19,32 +19,52 @@ import (
 	"compiler/transformer"
 )
 
+// Value is an argument of an operation, or what a variable holds. A PAIR is
+// a point, with its coordinates in Point. A PARAMETER is name=value, a formal
+// parameter with its default value or an option, with the name in Name and
+// the value in Default.
 type Value struct {
 	Type      int16
 	Name      string
-	Number    int16
+	Number    float64
 	Transform *transformer.Transform
+	Expr      *Expression
+	Point     []float64
+	Default   *Value
 }
 
 func NewVariableValue(name string) Value {
 	if ValidName(name) {
-		return Value{VARIABLE, name, 0, nil}
+		return Value{VARIABLE, name, 0, nil, nil, nil, nil}
 	}
-	return Value{NAN, "", 0, nil}
+	return Value{NAN, "", 0, nil, nil, nil, nil}
 }
 
 func NewTransformValue(tf *transformer.Transform) Value {
-	return Value{TRANSFORMER, "", 0, tf}
+	return Value{TRANSFORMER, "", 0, tf, nil, nil, nil}
+}
+
+// NewPointValue makes a value holding the point (x,y)
+func NewPointValue(x, y float64) Value {
+	return Value{PAIR, "", 0, nil, nil, []float64{x, y}, nil}
 }
 
 func (v *Value) Print() {
 	switch v.Type {
-	case INTEGER:
-		fmt.Printf("%d", v.Number)
+	case FLOAT:
+		fmt.Printf("%g", v.Number)
 	case TRANSFORMER:
 		v.Transform.Print()
 	case VARIABLE:
 		fmt.Printf("%s", v.Name)
+	case EXPRESSION:
+		fmt.Printf("%s", v.Expr.ToString())
+	case STRING:
+		fmt.Printf("%s", Quote(v.Name))
+	case PAIR:
+		fmt.Printf("(%g,%g)", v.Point[0], v.Point[1])
+	case PARAMETER:
+		fmt.Printf("%s=%s", v.Name, v.Default.ToString())
 	default:
 		fmt.Printf("undefined")
 	}
@@ -63,12 +83,20 @@ func ValuesPrint(vs []Value) {
 
 func (v *Value) ToString() string {
 	switch v.Type {
-	case INTEGER:
-		return fmt.Sprintf("%d", v.Number)
+	case FLOAT:
+		return fmt.Sprintf("%g", v.Number)
 	case TRANSFORMER:
 		return v.Transform.ToString()
 	case VARIABLE:
 		return fmt.Sprintf("%s", v.Name)
+	case EXPRESSION:
+		return v.Expr.ToString()
+	case STRING:
+		return Quote(v.Name)
+	case PAIR:
+		return fmt.Sprintf("(%g,%g)", v.Point[0], v.Point[1])
+	case PARAMETER:
+		return v.Name + "=" + v.Default.ToString()
 	}
 	return fmt.Sprintf("undefined")
 }
@@ -85,10 +113,10 @@ func ValuesToString(vs []Value) string {
 	return ret
 }
 
-func ValuesToInt(values []Value) ([]int16, bool) {
-	ret := make([]int16, len(values))
+func ValuesToFloat(values []Value) ([]float64, bool) {
+	ret := make([]float64, len(values))
 	for i, v := range values {
-		if v.Type != INTEGER {
+		if v.Type != FLOAT {
 			return ret, false
 		}
 		ret[i] = v.Number
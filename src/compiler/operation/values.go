@@ -34,11 +34,23 @@ func NeedArgNum(op int16) bool {
 	return needArgNum[GetType(op)]
 }
 
-func NewNumberValue(x int16) Value {
-	return Value{INTEGER, "", x, nil}
+// PathSegmentArgs gives the number of coordinates of a segment of PATH, like
+// 2 for the end point of line, and whether the keyword is a segment at all
+func PathSegmentArgs(keyword string) (int, bool) {
+	n, ok := pathSegments[keyword]
+	return n, ok
 }
 
-func NewNumberValues(args ...int16) []Value {
+func NewNumberValue(x float64) Value {
+	return Value{FLOAT, "", x, nil, nil, nil, nil}
+}
+
+// NewStringValue makes a value holding a string, which is kept in Name
+func NewStringValue(text string) Value {
+	return Value{STRING, text, 0, nil, nil, nil, nil}
+}
+
+func NewNumberValues(args ...float64) []Value {
 	ret := make([]Value, len(args))
 	for i, v := range args {
 		ret[i] = NewNumberValue(v)
@@ -52,14 +64,14 @@ func GetCommand(name string) (int16,bool) {
 }
 
 func GetName(op int16) string {
-	if int(op) >= len(operationNames) {
+	if op < 0 || int(op) >= len(operationNames) {
 		return "undefined"
 	}
 	return operationNames[op]
 }
 
 func GetType(op int16) int16 {
-	if int(op) >= len(operationTypes) {
+	if op < 0 || int(op) >= len(operationTypes) {
 		return UNDEFINED
 	}
 	return operationTypes[op]
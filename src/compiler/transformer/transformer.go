@@ -82,6 +82,182 @@ func FlipyTransform() *Transform {
 	return NewTransform(1,0,0,0,-1,0)
 }
 
+func ShearTransform(kx,ky float64) *Transform {
+	return NewTransform(1,kx,0,ky,1,0)
+}
+
+// RotateAboutTransform rotates by t around the point (cx,cy) instead of the
+// origin, i.e. translates the point to the origin, rotates and translates back
+func RotateAboutTransform(t,cx,cy float64) *Transform {
+	return TranslateTransform(cx,cy).Compose(RotateTransform(t)).Compose(
+		TranslateTransform(-cx,-cy))
+}
+
+// MirrorTransform reflects across the line through (x1,y1) and (x2,y2). It
+// fails if the two points are the same, so that there is no line.
+func MirrorTransform(x1,y1,x2,y2 float64) (*Transform,bool) {
+	dx,dy := x2-x1,y2-y1
+	l2 := dx*dx+dy*dy
+	if l2 < Tolerance {
+		return nil,false
+	}
+	// The reflection across a line through the origin at angle a is
+	// [[cos 2a, sin 2a], [sin 2a, -cos 2a]]
+	c,s := (dx*dx-dy*dy)/l2,2*dx*dy/l2
+	mirror := NewTransform(c,s,0,s,-c,0)
+	return TranslateTransform(x1,y1).Compose(mirror).Compose(
+		TranslateTransform(-x1,-y1)),true
+}
+
+// AffineMapTransform finds the affine transform mapping the three points in
+// src to the three points in dst. It fails if the points in src are on a line.
+func AffineMapTransform(src,dst [3][2]float64) (*Transform,bool) {
+	// With the points as the columns (x,y,1) of matrices S and D, the
+	// transform T satisfies T S = D, so T = D S^-1
+	s,d := new(Transform),new(Transform)
+	for j := 0; j < 3; j++ {
+		s.matrix[0][j],s.matrix[1][j],s.matrix[2][j] = src[j][0],src[j][1],1
+		d.matrix[0][j],d.matrix[1][j],d.matrix[2][j] = dst[j][0],dst[j][1],1
+	}
+	inv,ok := s.Inverse()
+	if !ok {
+		return nil,false
+	}
+	return d.Compose(inv),true
+}
+
+// HomographyTransform finds the projective transform mapping the four points
+// in src to the four points in dst. It fails if any three points in src or in
+// dst are on a line.
+func HomographyTransform(src,dst [4][2]float64) (*Transform,bool) {
+	bsrc,ok := projectiveBasis(src)
+	if !ok {
+		return nil,false
+	}
+	bdst,ok := projectiveBasis(dst)
+	if !ok {
+		return nil,false
+	}
+	inv,ok := bsrc.Inverse()
+	if !ok {
+		return nil,false
+	}
+	tf := bdst.Compose(inv)
+	// The matrix is only determined up to a factor, choose the one which
+	// keeps the last entry 1 like the affine transforms
+	if z := tf.matrix[2][2]; math.Abs(z) > Tolerance {
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				tf.matrix[i][j] /= z
+			}
+		}
+	}
+	return tf,true
+}
+
+// projectiveBasis finds the matrix mapping the points (1,0,0), (0,1,0),
+// (0,0,1) and (1,1,1) in homogeneous coordinates to the four points. Its
+// columns are the first three points (x,y,1) scaled by the factors which
+// make their sum the fourth point.
+func projectiveBasis(points [4][2]float64) (*Transform,bool) {
+	a := new(Transform)
+	for j := 0; j < 3; j++ {
+		a.matrix[0][j],a.matrix[1][j],a.matrix[2][j] = points[j][0],points[j][1],1
+	}
+	inv,ok := a.Inverse()
+	if !ok {
+		return nil,false
+	}
+	l1,l2,l3 := inv.Apply3(points[3][0],points[3][1],1)
+	for j,l := range []float64{l1,l2,l3} {
+		if math.Abs(l) < Tolerance {
+			return nil,false
+		}
+		for i := 0; i < 3; i++ {
+			a.matrix[i][j] *= l
+		}
+	}
+	return a,true
+}
+
+// Transform.IsAffine tells whether the last row of the matrix is 0 0 z, so
+// that it keeps lines parallel, unlike a perspective projection
+func (tf *Transform) IsAffine() bool {
+	m := tf.matrix
+	return math.Abs(m[2][0]) < Tolerance && math.Abs(m[2][1]) < Tolerance &&
+		math.Abs(m[2][2]) > Tolerance
+}
+
+// Transform.IsFinite tells whether all the entries of the matrix are finite
+// numbers, which they may not be after a transform is applied many times
+func (tf *Transform) IsFinite() bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.IsInf(tf.matrix[i][j],0) || math.IsNaN(tf.matrix[i][j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (tf *Transform) Determinant() float64 {
+	m := tf.matrix
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
+// Transform.Inverse computes the inverse matrix by the adjugate. It fails if
+// the matrix is singular, e.g. a scale by zero. The determinant is compared
+// to the product of the lengths of the rows, and that of the columns, which
+// bound it, so that a scale by a tiny factor is not taken for singular.
+func (tf *Transform) Inverse() (*Transform,bool) {
+	det := tf.Determinant()
+	m := tf.matrix
+	rows,columns := 1.0,1.0
+	for i := 0; i < 3; i++ {
+		rows *= math.Sqrt(m[i][0]*m[i][0]+m[i][1]*m[i][1]+m[i][2]*m[i][2])
+		columns *= math.Sqrt(m[0][i]*m[0][i]+m[1][i]*m[1][i]+m[2][i]*m[2][i])
+	}
+	if math.Abs(det) <= Tolerance*math.Min(rows,columns) {
+		return nil,false
+	}
+	inv := new(Transform)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// The cofactor of entry (j,i), using the cyclic order of the indices
+			// so that the sign comes out right
+			j1,j2 := (j+1)%3,(j+2)%3
+			i1,i2 := (i+1)%3,(i+2)%3
+			inv.matrix[i][j] = (m[j1][i1]*m[j2][i2]-m[j1][i2]*m[j2][i1])/det
+		}
+	}
+	return inv,true
+}
+
+// Transform.Power applies the transform n times, by repeated squaring. A
+// negative n applies the inverse, and fails if the matrix is singular.
+func (tf *Transform) Power(n int) (*Transform,bool) {
+	base := tf
+	if n < 0 {
+		var ok bool
+		base,ok = tf.Inverse()
+		if !ok {
+			return nil,false
+		}
+		n = -n
+	}
+	result := IdentityTransform()
+	for ; n > 0; n /= 2 {
+		if n%2 == 1 {
+			result = result.Compose(base)
+		}
+		base = base.Compose(base)
+	}
+	return result,true
+}
+
 func (tf1 *Transform) Compose(tf2 *Transform) *Transform {
 	tf := new(Transform)
 	for i := 0; i < 3; i++ {
@@ -109,3 +285,218 @@ func (tf *Transform) Apply(x, y float64) (tx,ty float64) {
 	ty /= tz
 	return
 }
+
+// Ellipse is the curve C + cos(t) U + sin(t) V, given by its centre C and a
+// pair of conjugate semi-diameters U and V. An axis-aligned oval with radii a
+// and b has U = (a,0) and V = (0,b).
+type Ellipse struct {
+	Cx,Cy float64
+	Ux,Uy float64
+	Vx,Vy float64
+}
+
+// Transform.ApplyEllipse computes the exact image of the ellipse. An affine
+// transform maps conjugate diameters to conjugate diameters, so the centre
+// and the two semi-diameters are mapped directly. A projective transform does
+// not keep the centre, so the image is recovered from the transformed conic.
+// That fails if the ellipse meets the line sent to infinity, where its image
+// is no longer bounded.
+func (tf *Transform) ApplyEllipse(e Ellipse) (Ellipse,bool) {
+	m := tf.matrix
+	if tf.IsAffine() {
+		z := m[2][2]
+		cx,cy := tf.Apply(e.Cx,e.Cy)
+		return Ellipse{cx,cy,
+			(m[0][0]*e.Ux+m[0][1]*e.Uy)/z,(m[1][0]*e.Ux+m[1][1]*e.Uy)/z,
+			(m[0][0]*e.Vx+m[0][1]*e.Vy)/z,(m[1][0]*e.Vx+m[1][1]*e.Vy)/z},true
+	}
+	// The ellipse is the image of the unit circle x^2+y^2-z^2 = 0 under the
+	// matrix with columns U, V and C, so after the transform it is the conic
+	// N^-T diag(1,1,-1) N^-1 where N is the composition of the two. It is
+	// worked out around C and its image P, since the entries of the conic
+	// would cancel for a small ellipse far from the origin.
+	px,py := tf.Apply(e.Cx,e.Cy)
+	if math.IsInf(px,0) || math.IsInf(py,0) || math.IsNaN(px) || math.IsNaN(py) {
+		return Ellipse{},false
+	}
+	local := TranslateTransform(-px,-py).Compose(tf).Compose(
+		TranslateTransform(e.Cx,e.Cy))
+	basis := &Transform{[3][3]float64{
+		{e.Ux,e.Vx,0},{e.Uy,e.Vy,0},{0,0,1}}}
+	inv,ok := local.Compose(basis).Inverse()
+	if !ok {
+		return Ellipse{},false
+	}
+	var q [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			q[i][j] = inv.matrix[0][i]*inv.matrix[0][j] +
+				inv.matrix[1][i]*inv.matrix[1][j] -
+				inv.matrix[2][i]*inv.matrix[2][j]
+		}
+	}
+	result,ok := conicToEllipse(q)
+	if !ok {
+		return Ellipse{},false
+	}
+	result.Cx,result.Cy = result.Cx+px,result.Cy+py
+	return result,true
+}
+
+// conicToEllipse finds the centre and the principal semi-axes of the conic
+// with the symmetric matrix q, if it is a real ellipse. The principal axes
+// are in particular a pair of conjugate semi-diameters.
+func conicToEllipse(q [3][3]float64) (Ellipse,bool) {
+	a,b,c := q[0][0],q[0][1],q[1][1]
+	d,e,f := q[0][2],q[1][2],q[2][2]
+	det := a*c-b*b
+	if det <= 0 {
+		return Ellipse{},false
+	}
+	cx,cy := (b*e-c*d)/det,(b*d-a*e)/det
+	// Around the centre the conic reads (p-c)^T S (p-c) = -k
+	k := f+d*cx+e*cy
+	if k == 0 {
+		return Ellipse{},false
+	}
+	a,b,c = -a/k,-b/k,-c/k
+	if a <= 0 {
+		return Ellipse{},false
+	}
+	t := math.Atan2(2*b,a-c)/2
+	cost,sint := math.Cos(t),math.Sin(t)
+	l1 := a*cost*cost+2*b*sint*cost+c*sint*sint
+	l2 := a*sint*sint-2*b*sint*cost+c*cost*cost
+	if l1 <= 0 || l2 <= 0 {
+		return Ellipse{},false
+	}
+	r1,r2 := 1/math.Sqrt(l1),1/math.Sqrt(l2)
+	return Ellipse{cx,cy,r1*cost,r1*sint,-r2*sint,r2*cost},true
+}
+
+// BezierKappa is the distance of the control points from the end points of
+// a cubic Bezier curve approximating a quarter of the unit circle.
+var BezierKappa float64 = 4*(math.Sqrt2-1)/3
+
+// Ellipse.Bezier returns the control points of four cubic Bezier curves
+// approximating the ellipse, for backends without a native ellipse. The list
+// starts with the point C+U, followed by two control points and the end point
+// of each quarter. The approximation of the circle is kept exactly by the
+// affine map onto the ellipse, so it is as good for any ellipse.
+func (e Ellipse) Bezier() []float64 {
+	k := BezierKappa
+	// Points on the unit circle, as multiples of U and V
+	circle := [][2]float64{
+		{1,0},
+		{1,k},{k,1},{0,1},
+		{-k,1},{-1,k},{-1,0},
+		{-1,-k},{-k,-1},{0,-1},
+		{k,-1},{1,-k},{1,0},
+	}
+	ret := make([]float64,len(circle)*2)
+	for i,p := range circle {
+		ret[2*i] = e.Cx+p[0]*e.Ux+p[1]*e.Vx
+		ret[2*i+1] = e.Cy+p[0]*e.Uy+p[1]*e.Vy
+	}
+	return ret
+}
+
+// maxBezierDepth limits how many times ApplyBezier halves a curve, to at most
+// 4096 pieces
+const maxBezierDepth = 12
+
+/*
+Transform.ApplyBezier maps the cubic Bezier curve given by its start point,
+two control points and end point, and gives the control points and the end
+point of the pieces of its image, without the start point.
+
+An affine transform maps the control points onto those of the image, so the
+image is one piece. A perspective projection does not, the image is not even
+a cubic curve, so the curve is halved until the curve through the mapped
+points of each piece is within tolerance of the image, at the quarters of the
+piece. It fails if the curve meets the line sent to infinity, or if it cannot
+be made close enough.
+*/
+func (tf *Transform) ApplyBezier(curve []float64, tolerance float64) ([]float64,bool) {
+	return tf.applyBezier(curve,tolerance,maxBezierDepth)
+}
+
+func (tf *Transform) applyBezier(curve []float64, tolerance float64,
+	depth int) ([]float64,bool) {
+	image := make([]float64,8)
+	for i := 0; i < 4; i++ {
+		image[2*i],image[2*i+1] = tf.Apply(curve[2*i],curve[2*i+1])
+	}
+	if tf.IsAffine() {
+		return image[2:],true
+	}
+	// The curve stays on one side of the line sent to infinity if its control
+	// points do, as it is in their convex hull
+	close := true
+	sign := tf.side(curve[0],curve[1])
+	for i := 1; i < 4; i++ {
+		if tf.side(curve[2*i],curve[2*i+1]) != sign {
+			close = false
+		}
+	}
+	for _,t := range []float64{0.25,0.5,0.75} {
+		if !close || sign == 0 {
+			break
+		}
+		x,y := bezierPoint(curve,t)
+		ex,ey := tf.Apply(x,y)
+		ax,ay := bezierPoint(image,t)
+		close = math.Hypot(ex-ax,ey-ay) <= tolerance
+	}
+	if close && sign != 0 {
+		return image[2:],true
+	}
+	if depth == 0 {
+		return nil,false
+	}
+	first,second := splitBezier(curve)
+	ret,ok := tf.applyBezier(first,tolerance,depth-1)
+	if !ok {
+		return nil,false
+	}
+	rest,ok := tf.applyBezier(second,tolerance,depth-1)
+	if !ok {
+		return nil,false
+	}
+	return append(ret,rest...),true
+}
+
+// Transform.side gives the sign of the last coordinate of the image of the
+// point, which is 0 on the line sent to infinity
+func (tf *Transform) side(x,y float64) int {
+	_,_,z := tf.Apply3(x,y,1)
+	if math.Abs(z) < Tolerance {
+		return 0
+	} else if z > 0 {
+		return 1
+	}
+	return -1
+}
+
+// bezierPoint gives the point at t of the cubic Bezier curve
+func bezierPoint(curve []float64, t float64) (float64,float64) {
+	s := 1-t
+	b0,b1,b2,b3 := s*s*s,3*s*s*t,3*s*t*t,t*t*t
+	return b0*curve[0]+b1*curve[2]+b2*curve[4]+b3*curve[6],
+		b0*curve[1]+b1*curve[3]+b2*curve[5]+b3*curve[7]
+}
+
+// splitBezier halves the cubic Bezier curve by the construction of de
+// Casteljau
+func splitBezier(curve []float64) ([]float64,[]float64) {
+	mid := func(a,b []float64) []float64 {
+		return []float64{(a[0]+b[0])/2,(a[1]+b[1])/2}
+	}
+	p0,p1,p2,p3 := curve[0:2],curve[2:4],curve[4:6],curve[6:8]
+	q0,q1,q2 := mid(p0,p1),mid(p1,p2),mid(p2,p3)
+	r0,r1 := mid(q0,q1),mid(q1,q2)
+	s := mid(r0,r1)
+	first := append(append(append(append([]float64{},p0...),q0...),r0...),s...)
+	second := append(append(append(append([]float64{},s...),r1...),q2...),p3...)
+	return first,second
+}
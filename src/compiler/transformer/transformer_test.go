@@ -109,3 +109,248 @@ func TestTranslateTransform(t *testing.T) {
 		}
 	}
 }
+
+func TestTransformInverse(t *testing.T) {
+	tfs := []*Transform {
+		IdentityTransform(),
+		NewTransform(1.5,0.1,2.0,-0.3,1.5,-4.0),
+		RotateTransform(0.7).Compose(TranslateTransform(3,-2)),
+		ShearTransform(0.5,0.2),
+		{[3][3]float64{{1,2,3},{0,1,4},{0.1,0.2,2}}},
+		ScaleTransform(1e-6,1e-6),
+		ScaleTransform(1e-4,1e-4).Compose(TranslateTransform(500,-300)),
+	}
+	for _,tf := range tfs {
+		inv,ok := tf.Inverse()
+		if !ok {
+			t.Errorf("Failed to invert %s",tf.ToString())
+			continue
+		}
+		if !tf.Compose(inv).Equal(IdentityTransform()) ||
+			!inv.Compose(tf).Equal(IdentityTransform()) {
+			t.Errorf("Wrong inverse of %s, got %s",tf.ToString(),inv.ToString())
+		}
+	}
+	singulars := []*Transform {
+		ScaleTransform(0,1),
+		NewTransform(1,2,0,2,4,0),
+		NewTransform(1e-6,2e-6,0,2e-6,4e-6,0),
+		NewTransform(1,1,0,1,1+1e-13,0),
+	}
+	for _,tf := range singulars {
+		if _,ok := tf.Inverse(); ok {
+			t.Errorf("Expect %s to be singular",tf.ToString())
+		}
+		if _,ok := tf.Power(-1); ok {
+			t.Errorf("Expect power -1 of %s to fail",tf.ToString())
+		}
+	}
+}
+
+func TestTransformPower(t *testing.T) {
+	tf := RotateTransform(0.3).Compose(TranslateTransform(1,0))
+	expect := IdentityTransform()
+	for n := 0; n <= 10; n++ {
+		result,ok := tf.Power(n)
+		if !ok || !result.Equal(expect) {
+			t.Errorf("Wrong power %d of %s",n,tf.ToString())
+		}
+		inv,_ := expect.Inverse()
+		result,ok = tf.Power(-n)
+		if !ok || !result.Equal(inv) {
+			t.Errorf("Wrong power %d of %s",-n,tf.ToString())
+		}
+		expect = expect.Compose(tf)
+	}
+	if result,ok := ScaleTransform(2,1).Power(10000); !ok || result.IsFinite() {
+		t.Errorf("Expect power 10000 of a scale by 2 to overflow")
+	}
+}
+
+func TestGeometricTransforms(t *testing.T) {
+	cases := []struct {
+		tf *Transform
+		x,y,tx,ty float64
+	} {
+		{ShearTransform(0.5,0),2,2,3,2},
+		{ShearTransform(0,-1),2,2,2,0},
+		{RotateAboutTransform(math.Pi/2,1,1),2,1,1,2},
+		{RotateAboutTransform(math.Pi,1,1),1,1,1,1},
+		{RotateAboutTransform(math.Pi,1,1),0,0,2,2},
+	}
+	mirror,ok := MirrorTransform(0,1,1,2)
+	if !ok {
+		t.Fatalf("Failed to create mirror transform")
+	}
+	cases = append(cases,[]struct {
+		tf *Transform
+		x,y,tx,ty float64
+	} {
+		{mirror,0,1,0,1},
+		{mirror,1,0,-1,2},
+		{mirror,3,3,2,4},
+	}...)
+	for _,c := range cases {
+		tx,ty := c.tf.Apply(c.x,c.y)
+		if math.Abs(tx-c.tx) > 1e-9 || math.Abs(ty-c.ty) > 1e-9 {
+			t.Errorf("Apply %s on [%f,%f], expect [%f,%f], got [%f,%f]",
+				c.tf.ToString(),c.x,c.y,c.tx,c.ty,tx,ty)
+		}
+	}
+	if _,ok := MirrorTransform(1,1,1,1); ok {
+		t.Errorf("Expect mirror across a single point to fail")
+	}
+}
+
+func TestAffineMapTransform(t *testing.T) {
+	src := [3][2]float64{{0,0},{1,0},{0,1}}
+	dst := [3][2]float64{{2,3},{4,3},{3,5}}
+	tf,ok := AffineMapTransform(src,dst)
+	if !ok {
+		t.Fatalf("Failed to find affine map")
+	}
+	if !tf.Equal(NewTransform(2,1,2,0,2,3)) {
+		t.Errorf("Wrong affine map, got %s",tf.ToString())
+	}
+	for i := 0; i < 3; i++ {
+		tx,ty := tf.Apply(src[i][0],src[i][1])
+		if math.Abs(tx-dst[i][0]) > 1e-9 || math.Abs(ty-dst[i][1]) > 1e-9 {
+			t.Errorf("Affine map sends [%f,%f] to [%f,%f], expect [%f,%f]",
+				src[i][0],src[i][1],tx,ty,dst[i][0],dst[i][1])
+		}
+	}
+	if _,ok := AffineMapTransform(
+		[3][2]float64{{0,0},{1,1},{2,2}},dst); ok {
+		t.Errorf("Expect affine map from collinear points to fail")
+	}
+}
+
+func TestHomographyTransform(t *testing.T) {
+	src := [4][2]float64{{0,0},{100,0},{100,100},{0,100}}
+	dst := [4][2]float64{{10,0},{90,0},{70,50},{30,50}}
+	tf,ok := HomographyTransform(src,dst)
+	if !ok {
+		t.Fatalf("Failed to find homography")
+	}
+	for i := 0; i < 4; i++ {
+		tx,ty := tf.Apply(src[i][0],src[i][1])
+		if math.Abs(tx-dst[i][0]) > 1e-9 || math.Abs(ty-dst[i][1]) > 1e-9 {
+			t.Errorf("Homography sends [%f,%f] to [%f,%f], expect [%f,%f]",
+				src[i][0],src[i][1],tx,ty,dst[i][0],dst[i][1])
+		}
+	}
+	// A trapezoid like this is a perspective view, so the centre of the square
+	// is not mapped to the centre of the trapezoid but further away
+	_,cy := tf.Apply(50,50)
+	if cy <= 25 || cy >= 50 {
+		t.Errorf("Expect centre to be mapped to y in (25,50), got %f",cy)
+	}
+	if _,ok := HomographyTransform(src,
+		[4][2]float64{{0,0},{1,1},{2,2},{0,5}}); ok {
+		t.Errorf("Expect homography to collinear points to fail")
+	}
+}
+
+// onEllipse tells whether the point is on the ellipse, by writing it in the
+// coordinates given by the two semi-diameters
+func onEllipse(e Ellipse, x, y float64) bool {
+	det := e.Ux*e.Vy-e.Uy*e.Vx
+	dx,dy := x-e.Cx,y-e.Cy
+	s,t := (dx*e.Vy-dy*e.Vx)/det,(e.Ux*dy-e.Uy*dx)/det
+	return math.Abs(s*s+t*t-1) < 1e-9
+}
+
+func TestApplyEllipse(t *testing.T) {
+	src := [4][2]float64{{0,0},{100,0},{100,100},{0,100}}
+	dst := [4][2]float64{{10,0},{90,0},{70,50},{30,50}}
+	homography,_ := HomographyTransform(src,dst)
+	tests := []*Transform {
+		IdentityTransform(),
+		RotateTransform(math.Pi/6),
+		ShearTransform(0.5,0).Compose(TranslateTransform(3,-2)),
+		ScaleTransform(2,-0.5).Compose(RotateTransform(1)),
+		homography,
+	}
+	ellipse := Ellipse{50,40,30,0,0,20}
+	for i,tf := range tests {
+		result,ok := tf.ApplyEllipse(ellipse)
+		if !ok {
+			t.Errorf("Failed to transform ellipse by transform %d",i)
+			continue
+		}
+		for k := 0; k < 16; k++ {
+			a := float64(k)*math.Pi/8
+			x,y := tf.Apply(ellipse.Cx+ellipse.Ux*math.Cos(a),
+				ellipse.Cy+ellipse.Vy*math.Sin(a))
+			if !onEllipse(result,x,y) {
+				t.Errorf("Transform %d sends point at angle %f to [%f,%f], "+
+					"which is not on %v",i,a,x,y,result)
+			}
+		}
+	}
+	result,_ := RotateTransform(math.Pi/2).ApplyEllipse(ellipse)
+	if math.Abs(result.Cx+40) > 1e-9 || math.Abs(result.Cy-50) > 1e-9 ||
+		math.Abs(result.Uy-30) > 1e-9 || math.Abs(result.Vx+20) > 1e-9 {
+		t.Errorf("Wrong rotated ellipse, got %v",result)
+	}
+	// A tiny oval is not taken for a degenerate one
+	tiny := Ellipse{50,40,1e-6,0,0,1e-6}
+	result,ok := homography.ApplyEllipse(tiny)
+	if x,y := homography.Apply(50,40); !ok ||
+		math.Abs(result.Cx-x) > 1e-5 || math.Abs(result.Cy-y) > 1e-5 {
+		t.Errorf("Wrong tiny ellipse, got %v %v",result,ok)
+	}
+	// The horizon of this homography is the line y = -100
+	if _,ok := homography.ApplyEllipse(Ellipse{50,-90,30,0,0,20}); ok {
+		t.Errorf("Expect ellipse crossing the horizon to fail")
+	}
+}
+
+func TestEllipseBezier(t *testing.T) {
+	e := Ellipse{1,2,3,1,-1,2}
+	points := e.Bezier()
+	if len(points) != 26 {
+		t.Fatalf("Expect 13 points, got %d",len(points)/2)
+	}
+	for i := 0; i < 13; i += 3 {
+		if !onEllipse(e,points[2*i],points[2*i+1]) {
+			t.Errorf("End point [%f,%f] not on ellipse",points[2*i],points[2*i+1])
+		}
+	}
+	if points[0] != points[24] || points[1] != points[25] {
+		t.Errorf("Expect the curve to be closed")
+	}
+}
+
+func TestApplyBezier(t *testing.T) {
+	curve := []float64{0,0,0,100,100,100,100,0}
+	tf := RotateTransform(math.Pi/2).Compose(TranslateTransform(5,0))
+	pieces,ok := tf.ApplyBezier(curve,0.1)
+	expect := []float64{-100,5,-100,105,0,105}
+	if !ok || len(pieces) != len(expect) {
+		t.Fatalf("Expect one piece %v, got %v %v",expect,pieces,ok)
+	}
+	for i := range expect {
+		if math.Abs(pieces[i]-expect[i]) > 1e-9 {
+			t.Errorf("Expect one piece %v, got %v",expect,pieces)
+			break
+		}
+	}
+	src := [4][2]float64{{0,0},{100,0},{100,100},{0,100}}
+	dst := [4][2]float64{{10,0},{90,0},{70,50},{30,50}}
+	homography,_ := HomographyTransform(src,dst)
+	pieces,ok = homography.ApplyBezier(curve,0.1)
+	if !ok || len(pieces) <= 6 || len(pieces)%6 != 0 {
+		t.Fatalf("Expect the curve split into pieces, got %v %v",pieces,ok)
+	}
+	x,y := homography.Apply(100,0)
+	if math.Abs(pieces[len(pieces)-2]-x) > 1e-9 ||
+		math.Abs(pieces[len(pieces)-1]-y) > 1e-9 {
+		t.Errorf("Expect the pieces to end at [%f,%f], got %v",x,y,pieces)
+	}
+	// The horizon of this homography is the line y = -100
+	if _,ok := homography.ApplyBezier(
+		[]float64{0,-90,0,-110,100,-110,100,-90},0.1); ok {
+		t.Errorf("Expect curve crossing the horizon to fail")
+	}
+}
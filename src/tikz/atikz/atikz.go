@@ -18,7 +18,8 @@ import "flag"
 import "fmt"
 import "os"
 import "log"
-import "io/ioutil"
+import "bufio"
+import "io"
 import "compiler/instruction"
 import "tikz/tikz"
 
@@ -28,6 +29,7 @@ var verbose bool
 var help bool
 var inputFileName string
 var outputFileName string
+var wide bool
 
 func usage(info string) {
 	fmt.Fprintf(os.Stderr, "This is atikz, version %s\n", Version)
@@ -44,6 +46,8 @@ func main() {
 	flag.BoolVar(&help, "help", false, "show help message")
 	flag.StringVar(&outputFileName, "o", "", "output file name")
 	flag.StringVar(&outputFileName, "output", "-", "output file name")
+	flag.BoolVar(&wide, "wide", false,
+		"read 32-bit coordinates from files without header")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s inputFile [options]\noptions:\n", os.Args[0])
 		flag.PrintDefaults()
@@ -70,36 +74,53 @@ func main() {
 	}
 	defer file.Close()
 
-	data := make([]byte,65536)
-	count, err := file.Read(data)
-	if err != nil {
-		log.Fatal(err)
+	encoding := instruction.WORD16
+	if wide {
+		encoding = instruction.WORD32
 	}
-
-	insts,err := instruction.BytesToInstructions(data[:count])
+	reader,err := instruction.NewReader(file,encoding)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	tz := tikz.NewTikz()
-	for _,inst := range insts {
-		err := tz.Update(inst)
+	// The instructions are converted one at a time as they are read, so the
+	// size of the drawing doesn't matter
+	var output io.Writer = os.Stdout
+	if outputFileName != "" && outputFileName != "-" {
+		outputFile,err := os.Create(outputFileName)
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer outputFile.Close()
+		output = outputFile
 	}
-
-	code,err := tz.GenerateTikzCode()
-	if err != nil {
+	buffered := bufio.NewWriter(output)
+	fail := func(err error) {
+		if output != os.Stdout {
+			os.Remove(outputFileName)
+		}
 		log.Fatal(err)
 	}
 
-	if outputFileName == "" || outputFileName == "-" {
-		fmt.Println(code)
-	} else {
-		err = ioutil.WriteFile(outputFileName, []byte(code), 0644)
+	header := reader.Header()
+	tw := tikz.NewWriter(buffered,header.Unit/instruction.DefaultUnit)
+	for {
+		inst,err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = tw.Write(inst)
+		}
 		if err != nil {
-			log.Fatal(err)
+			fail(err)
 		}
 	}
+	err = tw.Close()
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		fail(err)
+	}
 }
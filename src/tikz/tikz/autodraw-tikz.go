@@ -15,6 +15,8 @@
 package tikz
 
 import "fmt"
+import "io"
+import "strings"
 import "compiler/operation"
 import "compiler/instruction"
 
@@ -44,58 +46,274 @@ func NewTikz() *Tikz{
 	return tz
 }
 
+// Tikz.SetScale sets the factor applied to all the coordinates. With scale 1
+// a unit is 0.1mm, as 100 units make 1cm in tikz.
+func (tz *Tikz) SetScale(scale float64) {
+	tz.scale = scale
+}
+
 func (tz *Tikz) Update(inst instruction.Instruction) error {
 	tz.instlist = append(tz.instlist,inst)
 	return nil
 }
 
 func (tz *Tikz) GenerateTikzCode() (string,error) {
-	code := ""
-	options := ""
-
+	code := new(strings.Builder)
+	tw := NewWriter(code,tz.scale)
 	for _,inst := range tz.instlist {
-		tikzCode,err := InstToTikz(inst,tz.scale)
+		err := tw.Write(inst)
 		if err != nil {
 			return "",err
 		}
-		code += fmt.Sprintf("  %s\n",tikzCode)
 	}
+	err := tw.Close()
+	return code.String(),err
+}
+
+// Writer writes the tikz code of the instructions as they come, instead of
+// keeping them like Tikz does, so drawings of any size fit in memory
+type Writer struct {
+	w     io.Writer
+	scale float64
+	begun bool
+}
+
+func NewWriter(w io.Writer, scale float64) *Writer {
+	return &Writer{w,scale,false}
+}
+
+func (tw *Writer) begin() error {
+	if tw.begun {
+		return nil
+	}
+	tw.begun = true
+	options := ""
+	_,err := fmt.Fprintf(tw.w,"\\begin{tikzpicture}%s\n",options)
+	return err
+}
+
+// Writer.Write writes the code of one instruction, after the beginning of the
+// picture if it is the first one
+func (tw *Writer) Write(inst instruction.Instruction) error {
+	tikzCode,err := InstToTikz(inst,tw.scale)
+	if err != nil {
+		return err
+	}
+	err = tw.begin()
+	if err != nil {
+		return err
+	}
+	_,err = fmt.Fprintf(tw.w,"  %s\n",tikzCode)
+	return err
+}
 
-	return fmt.Sprintf("\\begin{tikzpicture}%s\n%s\\end{tikzpicture}\n",
-		options,code),nil
+// Writer.Close ends the picture. It does not close the underlying writer.
+func (tw *Writer) Close() error {
+	err := tw.begin()
+	if err != nil {
+		return err
+	}
+	_,err = fmt.Fprint(tw.w,"\\end{tikzpicture}\n")
+	return err
 }
 
 func InstToTikz(inst instruction.Instruction, scale float64) (string,error) {
+	style := inst.Style.OrDefault()
+	if err := style.Check(); err != nil {
+		return "",NewTikzError("invalid style: "+inst.ToString())
+	}
+	draw := pathCommand(style,arrowOptions(inst),scale)
 	switch inst.Command {
 	case operation.LINE:
-		return fmt.Sprintf("\\draw %s;",GenerateFloatPairs("--",
-					IntsToScaledFloats(inst.Args,scale))),nil
+		return fmt.Sprintf("%s %s;",draw,GenerateFloatPairs("--",
+					ScaleFloats(inst.Args,scale))),nil
 	case operation.RECT:
-		return fmt.Sprintf("\\draw %s -- cycle;",GenerateFloatPairs("--",
-				IntsToScaledFloats(inst.Args,scale))),nil
+		return fmt.Sprintf("%s %s -- cycle;",draw,GenerateFloatPairs("--",
+				ScaleFloats(inst.Args,scale))),nil
 	case operation.POLYGON:
-		return fmt.Sprintf("\\draw %s -- cycle;",GenerateFloatPairs("--",
-				IntsToScaledFloats(inst.Args[1:],scale))),nil
+		return fmt.Sprintf("%s %s -- cycle;",draw,GenerateFloatPairs("--",
+				ScaleFloats(inst.Args[1:],scale))),nil
+	case operation.POLYLINE:
+		return fmt.Sprintf("%s %s;",draw,GenerateFloatPairs("--",
+				ScaleFloats(inst.Args[1:],scale))),nil
+	case operation.PATH:
+		path,err := pathToTikz(inst,scale)
+		if err != nil {
+			return "",err
+		}
+		return fmt.Sprintf("%s %s;",draw,path),nil
 	case operation.OVAL:
-		return fmt.Sprintf("\\draw %s;",GenerateFloatPairsCurve(
-				IntsToScaledFloats(inst.Args,scale))),nil
+		// The unit circle mapped by the matrix with the two semi-diameters as
+		// columns, which tikz draws as an exact ellipse
+		args := ScaleFloats(inst.Args,scale)
+		cm := fmt.Sprintf("cm={%g,%g,%g,%g,(%g,%g)}",
+				args[2],args[3],args[4],args[5],args[0],args[1])
+		return fmt.Sprintf("%s (0,0) circle (1);",
+				pathCommand(style,[]string{cm},scale)),nil
+	case operation.TEXT:
+		// The text is LaTeX, passed through as it is
+		anchor,align := int(inst.Args[2]),int(inst.Args[3])
+		if anchor < 0 || anchor >= len(tikzAnchors) ||
+			align < 0 || align >= len(tikzAligns) {
+			return "",NewTikzError("invalid text: "+inst.ToString())
+		}
+		options := []string{}
+		if anchor != int(instruction.ANCHOR_CENTER) {
+			options = append(options,"anchor="+tikzAnchors[anchor])
+		}
+		options = append(options,"align="+tikzAligns[align])
+		options = append(options,textOptions(style)...)
+		args := ScaleFloats(inst.Args[:2],scale)
+		return fmt.Sprintf("\\node[%s] at (%g,%g) {%s};",
+				strings.Join(options,","),args[0],args[1],inst.Text),nil
 	default:
 		return "",NewTikzError("invalid instruction: "+inst.ToString())
 	}
 }
 
-func IntsToFloats(args []int16) []float64 {
-	ret := make([]float64,len(args))
-	for i,v := range args {
-		ret[i] = float64(v)
+// pathToTikz gives the segments of a PATH, where a move starts a new piece
+// without a line to it
+func pathToTikz(inst instruction.Instruction, scale float64) (string,error) {
+	segments,err := instruction.PathSegments(inst.Args[1:])
+	if err != nil {
+		return "",NewTikzError("invalid path: "+err.Error())
 	}
-	return ret
+	parts := []string{}
+	for _,segment := range segments {
+		coords := ScaleFloats(segment.Coords,scale)
+		switch segment.Tag {
+		case instruction.MOVE:
+			parts = append(parts,GenerateFloatPairs("",coords))
+		case instruction.LINE_STRIP:
+			parts = append(parts,"-- "+GenerateFloatPairs("",coords))
+		case instruction.CURVE:
+			parts = append(parts,".. controls "+
+				GenerateFloatPairs("and",coords[:4])+" .. "+
+				GenerateFloatPairs("",coords[4:]))
+		case instruction.CYCLE:
+			parts = append(parts,"-- cycle")
+		}
+	}
+	return strings.Join(parts," "),nil
 }
 
-func IntsToScaledFloats(args []int16, scale float64) []float64 {
+// pathCommand gives the command drawing a shape in the style, i.e. \draw,
+// \fill, \filldraw or \path for neither, with the options different from
+// the defaults of tikz after the given ones. The style must have been
+// checked.
+func pathCommand(style instruction.Style, options []string,
+	scale float64) string {
+	stroke := style.Stroke != instruction.COLOR_NONE
+	fill := style.Fill != instruction.COLOR_NONE
+	command := "\\path"
+	if stroke && fill {
+		command = "\\filldraw"
+	} else if stroke {
+		command = "\\draw"
+	} else if fill {
+		command = "\\fill"
+	}
+	if stroke && style.Stroke != instruction.COLOR_BLACK {
+		options = append(options,"draw="+tikzColors[style.Stroke])
+	}
+	if fill {
+		options = append(options,"fill="+tikzColors[style.Fill])
+	}
+	if stroke {
+		if style.Width > 0 {
+			// A unit is 0.1mm at scale 1, as for the coordinates
+			options = append(options,
+				fmt.Sprintf("line width=%gmm",style.Width/10*scale))
+		}
+		if style.Dash != instruction.DASH_SOLID {
+			options = append(options,tikzDashes[style.Dash])
+		}
+		if style.Cap != instruction.CAP_BUTT {
+			options = append(options,"line cap="+tikzCaps[style.Cap])
+		}
+		if style.Join != instruction.JOIN_MITER {
+			options = append(options,"line join="+tikzJoins[style.Join])
+		}
+	}
+	if style.Opacity != 1 {
+		options = append(options,fmt.Sprintf("opacity=%g",style.Opacity))
+	}
+	if len(options) == 0 {
+		return command
+	}
+	return command+"["+strings.Join(options,",")+"]"
+}
+
+// arrowOptions gives the arrow tips of the open ends of a line, like -> or
+// -Stealth, which come first in the options
+func arrowOptions(inst instruction.Instruction) []string {
+	arrows := instruction.Arrows(inst)
+	if arrows == instruction.ARROW_NONE {
+		return nil
+	}
+	head := inst.Style.OrDefault().Head
+	start,end := "<",">"
+	if head != instruction.HEAD_TO {
+		start,end = tikzHeads[head],tikzHeads[head]
+	}
+	switch arrows {
+	case instruction.ARROW_START:
+		return []string{start+"-"}
+	case instruction.ARROW_END:
+		return []string{"-"+end}
+	default:
+		return []string{start+"-"+end}
+	}
+}
+
+// textOptions gives the options of a node in the style, where the text has
+// the color of the lines and the fill is behind it
+func textOptions(style instruction.Style) []string {
+	options := []string{}
+	if style.Stroke == instruction.COLOR_NONE {
+		options = append(options,"text opacity=0")
+	} else if style.Stroke != instruction.COLOR_BLACK {
+		options = append(options,"text="+tikzColors[style.Stroke])
+	}
+	if style.Fill != instruction.COLOR_NONE {
+		options = append(options,"fill="+tikzColors[style.Fill])
+	}
+	if style.Opacity != 1 {
+		options = append(options,fmt.Sprintf("opacity=%g",style.Opacity))
+	}
+	return options
+}
+
+// The names in tikz of the anchors and alignments of text, in the order of
+// their numbers in the instruction package
+var tikzAnchors = []string{
+	"center","north","south","east","west",
+	"north east","north west","south east","south west","base",
+}
+
+var tikzAligns = []string{"center","left","right"}
+
+// The names in tikz of the colors, dash patterns, line caps, joins and arrow
+// tips of a style. The arrow tips other than to are those of the arrows.meta
+// library.
+var tikzColors = []string{
+	"none","black","white","red","green","blue","cyan","magenta","yellow",
+	"gray","darkgray","lightgray","brown","lime","olive","orange","pink",
+	"purple","teal","violet",
+}
+
+var tikzDashes = []string{"solid","dashed","dotted","dash dot"}
+
+var tikzCaps = []string{"butt","round","rect"}
+
+var tikzJoins = []string{"miter","round","bevel"}
+
+var tikzHeads = []string{"to","Stealth","Latex"}
+
+func ScaleFloats(args []float64, scale float64) []float64 {
 	ret := make([]float64,len(args))
 	for i,v := range args {
-		ret[i] = float64(v)/100.0 * scale
+		ret[i] = v/100.0 * scale
 	}
 	return ret
 }
@@ -115,25 +333,3 @@ func GenerateFloatPairs(connect string, args []float64) string {
 	}
 	return ret
 }
-
-func GenerateFloatPairsCurve(args []float64) string {
-	if len(args) < 2 {
-		return ""
-	}
-	if len(args)%4 != 0 {
-		return ""
-	}
-	args = append(args,args[0],args[1])
-	num := len(args)/4
-	ret := fmt.Sprintf("(%g,%g)",args[0],args[1])
-	for i := 0; i < num; i++ {
-		x0,y0 := args[i*4],args[i*4+1]
-		x1,y1 := args[i*4+2],args[i*4+3]
-		x2,y2 := args[i*4+4],args[i*4+5]
-		bx1,by1 := x0*0.45+x1*0.55,y0*0.45+y1*0.55
-		bx2,by2 := x2*0.45+x1*0.55,y2*0.45+y1*0.55
-		ret += fmt.Sprintf(" .. controls (%g,%g) and (%g,%g) .. (%g,%g)",
-			bx1,by1,bx2,by2,x2,y2)
-	}
-	return ret
-}
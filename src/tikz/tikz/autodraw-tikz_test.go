@@ -20,16 +20,16 @@ import "compiler/instruction"
 
 func TestUpdate(t *testing.T) {
 	tests := []instruction.Instruction {
-		{operation.LINE,[]int16{120,300,110,310}},
-		{operation.RECT,[]int16{110,0,110,110,0,110,0,0}},
-		{operation.POLYGON,[]int16{6,110,100,0,10,210,220}},
-		//{operation.OVAL,[]int16{100,100,100,0,0,100,0,0,0,-100,-100,0,-100,-100,-100,100}},
+		{Command: operation.LINE, Args: []float64{120,300,110,310}},
+		{Command: operation.RECT, Args: []float64{110,0,110,110,0,110,0,0}},
+		{Command: operation.POLYGON, Args: []float64{6,110,100,0,10,210,220}},
+		{Command: operation.OVAL, Args: []float64{100,100,100,50,-20,80}},
 	}
 	expect := "\\begin{tikzpicture}\n"+
 		"  \\draw (1.2,3) -- (1.1,3.1);\n"+
 		"  \\draw (1.1,0) -- (1.1,1.1) -- (0,1.1) -- (0,0) -- cycle;\n"+
 		"  \\draw (1.1,1) -- (0,0.1) -- (2.1,2.2) -- cycle;\n"+
-		//"  \\draw (1,1) .. controls (1,0.5) and (0.5,0.5) .. (0,1) .. controls (0,0.5) and (0,-0.5) .. (0,-1) .. controls (-0.5,-0.5) and (-1,-0.5) .. (-1,-1) .. controls (-1,0) and (0,1) .. (1,1);\n"+
+		"  \\draw[cm={1,0.5,-0.2,0.8,(1,1)}] (0,0) circle (1);\n"+
 		"\\end{tikzpicture}\n"
 	tz := NewTikz()
 	for _,inst := range tests {
@@ -50,17 +50,77 @@ func TestUpdate(t *testing.T) {
 }
 
 func TestInstToTikz(t *testing.T) {
+	dashed := instruction.DefaultStyle()
+	dashed.Width,dashed.Dash,dashed.Cap = 2.5,instruction.DASH_DASHED,
+		instruction.CAP_ROUND
+	filled := instruction.DefaultStyle()
+	filled.Stroke,filled.Fill = instruction.COLOR_RED,instruction.COLOR_YELLOW
+	filled.Join,filled.Opacity = instruction.JOIN_BEVEL,0.5
+	arrow := instruction.DefaultStyle()
+	arrow.Arrow = instruction.ARROW_END
+	stealth := instruction.DefaultStyle()
+	stealth.Stroke,stealth.Arrow,stealth.Head = instruction.COLOR_BLUE,
+		instruction.ARROW_BOTH,instruction.HEAD_STEALTH
+	invisible := instruction.DefaultStyle()
+	invisible.Stroke = instruction.COLOR_NONE
 	tests := []instruction.Instruction {
-		{operation.LINE,[]int16{120,300,110,310}},
-		{operation.RECT,[]int16{110,0,110,110,0,110,0,0}},
-		{operation.POLYGON,[]int16{6,110,100,0,10,210,220}},
-		//{operation.OVAL,[]int16{100,100,100,0,0,100,0,0,0,-100,-100,0,-100,-100,-100,100}},
+		{Command: operation.LINE, Args: []float64{120,300,110,310}},
+		{Command: operation.RECT, Args: []float64{110,0,110,110,0,110,0,0}},
+		{Command: operation.POLYGON, Args: []float64{6,110,100,0,10,210,220}},
+		{Command: operation.OVAL, Args: []float64{100,100,100,50,-20,80}},
+		{Command: operation.TEXT, Args: []float64{150,-20,
+			float64(instruction.ANCHOR_CENTER),float64(instruction.ALIGN_CENTER)},
+			Text: "label"},
+		{Command: operation.TEXT, Args: []float64{0,10,
+			float64(instruction.ANCHOR_NORTH_WEST),float64(instruction.ALIGN_LEFT)},
+			Text: `$\alpha_1$ \\ {\bf b}`},
+		{Command: operation.LINE, Args: []float64{0,0,100,0},Style: &dashed},
+		{Command: operation.RECT, Args: []float64{0,0,0,10,10,10,10,0},
+			Style: &filled},
+		{Command: operation.OVAL, Args: []float64{0,0,10,0,0,10},Style: &filled},
+		{Command: operation.POLYGON, Args: []float64{6,0,0,10,0,0,10},
+			Style: &invisible},
+		{Command: operation.TEXT, Args: []float64{0,0,
+			float64(instruction.ANCHOR_CENTER),float64(instruction.ALIGN_CENTER)},
+			Text: "c",Style: &filled},
+		{Command: operation.PATH, Args: []float64{20,float64(instruction.MOVE),
+			0,0,float64(instruction.CURVE),10,10,20,10,30,0,
+			float64(instruction.LINE_STRIP),30,-10,float64(instruction.CYCLE),
+			float64(instruction.MOVE),50,50,float64(instruction.LINE_STRIP),60,60}},
+		{Command: operation.POLYLINE, Args: []float64{6,0,0,10,10,20,0}},
+		{Command: operation.LINE, Args: []float64{0,0,100,0},Style: &arrow},
+		{Command: operation.POLYLINE, Args: []float64{6,0,0,10,10,20,0},
+			Style: &stealth},
+		// No arrow on the closed first piece, nor on a polygon
+		{Command: operation.PATH, Args: []float64{12,float64(instruction.MOVE),
+			0,0,float64(instruction.LINE_STRIP),10,0,float64(instruction.CYCLE),
+			float64(instruction.MOVE),50,50,float64(instruction.LINE_STRIP),60,60},
+			Style: &stealth},
+		{Command: operation.POLYGON, Args: []float64{6,0,0,10,0,0,10},
+			Style: &arrow},
 	}
 	expects := []string {
 		"\\draw (1.2,3) -- (1.1,3.1);",
 		"\\draw (1.1,0) -- (1.1,1.1) -- (0,1.1) -- (0,0) -- cycle;",
 		"\\draw (1.1,1) -- (0,0.1) -- (2.1,2.2) -- cycle;",
-		//"\\draw (1,1) .. controls (1,0.5) and (0.5,0.5) .. (0,1) .. controls (0,0.5) and (0,-0.5) .. (0,-1) .. controls (-0.5,-0.5) and (-1,-0.5) .. (-1,-1) .. controls (-1,0) and (0,1) .. (1,1);",
+		"\\draw[cm={1,0.5,-0.2,0.8,(1,1)}] (0,0) circle (1);",
+		"\\node[align=center] at (1.5,-0.2) {label};",
+		`\node[anchor=north west,align=left] at (0,0.1) {$\alpha_1$ \\ {\bf b}};`,
+		"\\draw[line width=0.25mm,dashed,line cap=round] (0,0) -- (1,0);",
+		"\\filldraw[draw=red,fill=yellow,line join=bevel,opacity=0.5] "+
+			"(0,0) -- (0,0.1) -- (0.1,0.1) -- (0.1,0) -- cycle;",
+		"\\filldraw[cm={0.1,0,0,0.1,(0,0)},draw=red,fill=yellow,"+
+			"line join=bevel,opacity=0.5] (0,0) circle (1);",
+		"\\path (0,0) -- (0.1,0) -- (0,0.1) -- cycle;",
+		"\\node[align=center,text=red,fill=yellow,opacity=0.5] at (0,0) {c};",
+		"\\draw (0,0) .. controls (0.1,0.1) and (0.2,0.1) .. (0.3,0) "+
+			"-- (0.3,-0.1) -- cycle (0.5,0.5) -- (0.6,0.6);",
+		"\\draw (0,0) -- (0.1,0.1) -- (0.2,0);",
+		"\\draw[->] (0,0) -- (1,0);",
+		"\\draw[Stealth-Stealth,draw=blue] (0,0) -- (0.1,0.1) -- (0.2,0);",
+		"\\draw[-Stealth,draw=blue] (0,0) -- (0.1,0) -- cycle "+
+			"(0.5,0.5) -- (0.6,0.6);",
+		"\\draw (0,0) -- (0.1,0) -- (0,0.1) -- cycle;",
 	}
 	for i,inst := range tests {
 		tikzCode,err := InstToTikz(inst,1.0)